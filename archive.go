@@ -0,0 +1,151 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Support for library archives. A .zip, .tar, .tar.gz or .tgz file can be
+// used by FileImporter like a directory, e.g. as one of the JPaths.
+// The files inside have paths like "vendor/lib.zip/foo/bar.libsonnet".
+
+var archiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+func hasArchiveExtension(p string) bool {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// isArchive checks if the path points to an archive file (rather than
+// e.g. a directory with a name ending with .zip).
+func isArchive(p string) bool {
+	if !hasArchiveExtension(p) {
+		return false
+	}
+	info, err := os.Stat(p)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// splitArchivePath checks if the path points inside an archive and returns
+// the path of the archive and the slash-separated path of the entry.
+func splitArchivePath(p string) (archivePath string, entry string, inArchive bool) {
+	for i := 0; i < len(p); i++ {
+		if p[i] != filepath.Separator || i == 0 {
+			continue
+		}
+		if isArchive(p[:i]) {
+			return p[:i], filepath.ToSlash(p[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// archiveContents holds all files in an archive.
+type archiveContents map[string]Contents
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func readArchive(archivePath string) (archiveContents, error) {
+	var result archiveContents
+	var err error
+	if strings.HasSuffix(archivePath, ".zip") {
+		result, err = readZipArchive(archivePath)
+	} else {
+		result, err = readTarArchive(archivePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %#v: %v", archivePath, err)
+	}
+	return result, nil
+}
+
+func readZipArchive(archivePath string) (archiveContents, error) {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	result := make(archiveContents)
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("entry %#v: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("entry %#v: %v", f.Name, err)
+		}
+		result[cleanEntryName(f.Name)] = MakeContentsRaw(data)
+	}
+	return result, nil
+}
+
+func readTarArchive(archivePath string) (archiveContents, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	result := make(archiveContents)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("entry %#v: %v", header.Name, err)
+		}
+		result[cleanEntryName(header.Name)] = MakeContentsRaw(data)
+	}
+	return result, nil
+}
@@ -38,6 +38,66 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
+// allocatedResult accounts for the string or array returned by a builtin
+// or an operator. Only what was created for it is counted: a result which
+// is one of the arguments returned unchanged was accounted for when it was
+// created. The strings and arrays nested in a new result, e.g. the ones
+// returned by std.split, are accounted for by the builtin, see
+// allocateElements.
+func allocatedResult(i *interpreter, result value, args ...value) (value, error) {
+	if err := i.allocate(allocatedSize(result, args)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// allocatedSize returns the number of string characters and array elements
+// created for result, which are not shared with args.
+func allocatedSize(result value, args []value) int {
+	if isArgument(result, args) {
+		return 0
+	}
+	switch result := result.(type) {
+	case *valueStringTree:
+		// A concatenation shares the concatenated strings, so only the
+		// node is counted, as one character, unless a part was created
+		// with it, e.g. the string converted from the number in "a" + 1.
+		size := 1
+		if !isArgument(result.left, args) {
+			size += result.left.length()
+		}
+		if !isArgument(result.right, args) {
+			size += result.right.length()
+		}
+		return size
+	case valueString:
+		return result.length()
+	case *valueArray:
+		return result.length()
+	}
+	return 0
+}
+
+func isArgument(v value, args []value) bool {
+	for _, arg := range args {
+		if arg == v {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateElements accounts for the strings and arrays created as the
+// elements of a new array, e.g. by std.split. The array itself is
+// accounted for by allocatedResult.
+func allocateElements(i *interpreter, elements []*cachedThunk) error {
+	size := 0
+	for _, element := range elements {
+		size += allocatedSize(element.content, nil)
+	}
+	return i.allocate(size)
+}
+
 func builtinPlus(i *interpreter, x, y value) (value, error) {
 	// TODO(sbarzowski) perhaps a more elegant way to dispatch
 	switch right := y.(type) {
@@ -248,6 +308,11 @@ func valueToString(i *interpreter, x value) (string, error) {
 }
 
 func builtinToString(i *interpreter, x value) (value, error) {
+	// A string is returned as it is, so that a concatenation shares it
+	// instead of copying it.
+	if str, ok := x.(valueString); ok {
+		return str, nil
+	}
 	s, err := valueToString(i, x)
 	if err != nil {
 		return nil, err
@@ -287,14 +352,20 @@ func builtinMakeArray(i *interpreter, szv, funcv value) (value, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := i.checkAllocation(sz); err != nil {
+		return nil, err
+	}
 	var elems []*cachedThunk
-	for i := 0; i < sz; i++ {
+	for index := 0; index < sz; index++ {
+		if err := i.checkInterrupted(); err != nil {
+			return nil, err
+		}
 		elem := &cachedThunk{
 			env: &environment{},
 			body: &astMakeArrayElement{
 				NodeBase: ast.NodeBase{},
 				function: fun,
-				index:    i,
+				index:    index,
 			},
 		}
 		elems = append(elems, elem)
@@ -702,9 +773,15 @@ func builtinRange(i *interpreter, fromv, tov value) (value, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := i.checkAllocation(to - from + 1); err != nil {
+		return nil, err
+	}
 	elems := make([]*cachedThunk, to-from+1)
-	for i := from; i <= to; i++ {
-		elems[i-from] = readyThunk(intToValue(i))
+	for n := from; n <= to; n++ {
+		if err := i.checkInterrupted(); err != nil {
+			return nil, err
+		}
+		elems[n-from] = readyThunk(intToValue(n))
 	}
 	return makeValueArray(elems), nil
 }
@@ -1207,6 +1284,9 @@ func builtinObjectFieldsEx(i *interpreter, objv, includeHiddenV value) (value, e
 	for _, fieldname := range fields {
 		elems = append(elems, readyThunk(makeValueString(fieldname)))
 	}
+	if err := allocateElements(i, elems); err != nil {
+		return nil, err
+	}
 	return makeValueArray(elems), nil
 }
 
@@ -1332,6 +1412,9 @@ func builtinSplitLimit(i *interpreter, strv, cv, maxSplitsV value) (value, error
 	for i := range strs {
 		res[i] = readyThunk(makeValueString(strs[i]))
 	}
+	if err := allocateElements(i, res); err != nil {
+		return nil, err
+	}
 
 	return makeValueArray(res), nil
 }
@@ -1373,6 +1456,9 @@ func builtinSplitLimitR(i *interpreter, strv, cv, maxSplitsV value) (value, erro
 	for i := range strs {
 		res[i] = readyThunk(makeValueString(strs[i]))
 	}
+	if err := allocateElements(i, res); err != nil {
+		return nil, err
+	}
 
 	return makeValueArray(res), nil
 }
@@ -1509,6 +1595,7 @@ func builtinUglyObjectFlatMerge(i *interpreter, x value) (value, error) {
 
 			newFields[fieldName] = simpleObjectField{
 				hide: fieldVal.hide,
+				loc:  fieldVal.loc,
 				field: &bindingsUnboundField{
 					inner:    fieldVal.field,
 					bindings: simpleObj.upValues,
@@ -2461,6 +2548,7 @@ func builtInObjectRemoveKey(i *interpreter, objv value, keyv value) (value, erro
 
 		newFields[fieldName] = simpleObjectField{
 			hide: fieldVal.hide,
+			loc:  fieldVal.loc,
 			field: &bindingsUnboundField{
 				inner:    fieldVal.field,
 				bindings: simpleObj.upValues,
@@ -2521,7 +2609,11 @@ func (b *unaryBuiltin) evalCall(args callArguments, i *interpreter) (value, erro
 	if err != nil {
 		return nil, err
 	}
-	return b.function(i, x)
+	result, err := b.function(i, x)
+	if err != nil {
+		return nil, err
+	}
+	return allocatedResult(i, result, x)
 }
 
 func (b *unaryBuiltin) parameters() []namedParameter {
@@ -2555,7 +2647,11 @@ func (b *binaryBuiltin) evalCall(args callArguments, i *interpreter) (value, err
 	if err != nil {
 		return nil, err
 	}
-	return b.function(i, x, y)
+	result, err := b.function(i, x, y)
+	if err != nil {
+		return nil, err
+	}
+	return allocatedResult(i, result, x, y)
 }
 
 func (b *binaryBuiltin) parameters() []namedParameter {
@@ -2593,7 +2689,11 @@ func (b *ternaryBuiltin) evalCall(args callArguments, i *interpreter) (value, er
 	if err != nil {
 		return nil, err
 	}
-	return b.function(i, x, y, z)
+	result, err := b.function(i, x, y, z)
+	if err != nil {
+		return nil, err
+	}
+	return allocatedResult(i, result, x, y, z)
 }
 
 func (b *ternaryBuiltin) parameters() []namedParameter {
@@ -2664,7 +2764,11 @@ func (b *generalBuiltin) evalCall(args callArguments, i *interpreter) (value, er
 			return nil, err
 		}
 	}
-	return b.function(i, values)
+	result, err := b.function(i, values)
+	if err != nil {
+		return nil, err
+	}
+	return allocatedResult(i, result, values...)
 }
 
 // End of builtin utils
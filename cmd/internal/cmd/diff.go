@@ -0,0 +1,133 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// diffContext is the number of unchanged lines shown around the changes.
+const diffContext = 3
+
+type diffLine struct {
+	text string
+	op   diffmatchpatch.Operation
+}
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// UnifiedDiff returns the differences between oldText and newText in the
+// unified format of diff -u. It is empty if the texts are the same.
+func UnifiedDiff(oldName, newName, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+	dmp := diffmatchpatch.New()
+	oldChars, newChars, lineArray := dmp.DiffLinesToChars(oldText, newText)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(oldChars, newChars, false), lineArray)
+	var lines []diffLine
+	for _, diff := range diffs {
+		for _, text := range splitLines(diff.Text) {
+			lines = append(lines, diffLine{text: text, op: diff.Type})
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	// oldLine and newLine are the numbers of lines before lines[index].
+	oldLine, newLine := 0, 0
+	for index := 0; index < len(lines); {
+		if lines[index].op == diffmatchpatch.DiffEqual {
+			oldLine++
+			newLine++
+			index++
+			continue
+		}
+		// A hunk starts with up to diffContext unchanged lines and continues
+		// until there are more than 2*diffContext unchanged lines in a row.
+		start := index - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := index
+		for equal := 0; end < len(lines) && equal <= 2*diffContext; end++ {
+			if lines[end].op == diffmatchpatch.DiffEqual {
+				equal++
+			} else {
+				equal = 0
+			}
+		}
+		for end > index && lines[end-1].op == diffmatchpatch.DiffEqual {
+			end--
+		}
+		if end+diffContext < len(lines) {
+			end += diffContext
+		} else {
+			end = len(lines)
+		}
+
+		oldStart, newStart := oldLine-(index-start), newLine-(index-start)
+		oldCount, newCount := 0, 0
+		var hunk strings.Builder
+		for _, line := range lines[start:end] {
+			switch line.op {
+			case diffmatchpatch.DiffEqual:
+				hunk.WriteString(" ")
+				oldCount++
+				newCount++
+			case diffmatchpatch.DiffDelete:
+				hunk.WriteString("-")
+				oldCount++
+			case diffmatchpatch.DiffInsert:
+				hunk.WriteString("+")
+				newCount++
+			}
+			hunk.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				hunk.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		out.WriteString(hunk.String())
+
+		oldLine += oldCount - (index - start)
+		newLine += newCount - (index - start)
+		index = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the range of lines in a hunk header. The start is
+// 1-based, except for empty ranges, which use the line before them.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -27,6 +27,8 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strconv"
+
+	"github.com/google/go-jsonnet"
 )
 
 // NextArg retrieves the next argument from the commandline.
@@ -142,6 +144,21 @@ func WriteOutputFile(output string, outputFile string, createDirs bool) (err err
 	return err
 }
 
+// MakeImporter returns the importer used by the commands: a FileImporter
+// with the given library search paths, which resolves the import paths using
+// the import map loaded from importMapFile, unless it is "".
+func MakeImporter(jpaths []string, importMapFile string) (jsonnet.Importer, error) {
+	var importer jsonnet.Importer = &jsonnet.FileImporter{JPaths: jpaths}
+	if importMapFile == "" {
+		return importer, nil
+	}
+	importMap, err := jsonnet.LoadImportMap(importMapFile)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonnet.ImportMapImporter{Importer: importer, Map: importMap}, nil
+}
+
 // StartCPUProfile creates a CPU profile if requested by environment
 // variable.
 func StartCPUProfile() {
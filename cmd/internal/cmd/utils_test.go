@@ -17,6 +17,8 @@ limitations under the License.
 package cmd
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -56,3 +58,33 @@ func TestSimplifyArgs(t *testing.T) {
 	testSimplifyAux(t, "-abc", []string{"-abc"}, []string{"-a", "-b", "-c"})
 	testSimplifyAux(t, "-acb", []string{"-acb"}, []string{"-a", "-c", "-b"})
 }
+
+func TestMakeImporter(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "lib", "a.libsonnet"), []byte("42"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	importMapFile := filepath.Join(dir, "importmap.json")
+	if err := os.WriteFile(importMapFile, []byte(`{"imports": {"x/": "lib/"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	importer, err := MakeImporter(nil, importMapFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	contents, _, err := importer.Import(dir, "x/a.libsonnet")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if contents.String() != "42" {
+		t.Errorf("Got %q, expected %q", contents.String(), "42")
+	}
+
+	if _, err := MakeImporter(nil, filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Expected an error for a missing import map")
+	}
+}
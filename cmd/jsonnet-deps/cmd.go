@@ -41,7 +41,13 @@ func usage(o io.Writer) {
 	fmt.Fprintln(o, "Available options:")
 	fmt.Fprintln(o, "  -h / --help                This message")
 	fmt.Fprintln(o, "  -J / --jpath <dir>         Specify an additional library search dir")
+	fmt.Fprintln(o, "                             or archive (.zip, .tar, .tar.gz, .tgz)")
 	fmt.Fprintln(o, "                             (right-most wins)")
+	fmt.Fprintln(o, "  --import-map <file>        Resolve import paths using the given import map")
+	fmt.Fprintln(o, "  --lockfile <file>          Verify the hashes of the imported files against")
+	fmt.Fprintln(o, "                             the lockfile")
+	fmt.Fprintln(o, "  --write-lockfile <file>    Record the hashes of the imported files in the")
+	fmt.Fprintln(o, "                             lockfile")
 	fmt.Fprintln(o, "  -o / --output-file <file>  Write to the output file rather than stdout")
 	fmt.Fprintln(o, "  --version                  Print version")
 	fmt.Fprintln(o)
@@ -63,7 +69,11 @@ func usage(o io.Writer) {
 type config struct {
 	inputFiles []string
 	outputFile string
-	jPaths     []string
+	importMap  string
+	// lockfile is verified, unless writeLockfile is set.
+	lockfile      string
+	writeLockfile bool
+	jPaths        []string
 }
 
 type processArgsStatus int
@@ -99,6 +109,19 @@ func processArgs(givenArgs []string, conf *config, vm *jsonnet.VM) (processArgsS
 				return processArgsStatusFailure, fmt.Errorf("-J argument was empty string")
 			}
 			conf.jPaths = append(conf.jPaths, dir)
+		} else if arg == "--import-map" {
+			importMap := cmd.NextArg(&i, args)
+			if len(importMap) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--import-map argument was empty string")
+			}
+			conf.importMap = importMap
+		} else if arg == "--lockfile" || arg == "--write-lockfile" {
+			lockfile := cmd.NextArg(&i, args)
+			if len(lockfile) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("%s argument was empty string", arg)
+			}
+			conf.lockfile = lockfile
+			conf.writeLockfile = arg == "--write-lockfile"
 		} else if arg == "--" {
 			// All subsequent args are not options.
 			i++
@@ -184,7 +207,26 @@ func main() {
 		os.Exit(1)
 	}
 
-	vm.Importer(&jsonnet.FileImporter{JPaths: conf.jPaths})
+	importer, err := cmd.MakeImporter(conf.jPaths, conf.importMap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	vm.Importer(importer)
+
+	var lockfile *jsonnet.Lockfile
+	if conf.writeLockfile {
+		lockfile = &jsonnet.Lockfile{BaseDir: filepath.Dir(conf.lockfile)}
+		vm.Lockfile(lockfile, jsonnet.LockfileRecord)
+	} else if conf.lockfile != "" {
+		var err error
+		lockfile, err = jsonnet.LoadLockfile(conf.lockfile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		vm.Lockfile(lockfile, jsonnet.LockfileVerify)
+	}
 
 	for _, file := range conf.inputFiles {
 		if _, err := os.Stat(file); err != nil {
@@ -200,6 +242,13 @@ func main() {
 	}
 	cmd.MemProfile()
 
+	if conf.writeLockfile {
+		if err := lockfile.Save(conf.lockfile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
 	err = writeDependencies(dependencies, conf.outputFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
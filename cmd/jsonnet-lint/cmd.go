@@ -25,7 +25,9 @@ func usage(o io.Writer) {
 	fmt.Fprintln(o, "Available options:")
 	fmt.Fprintln(o, "  -h / --help                This message")
 	fmt.Fprintln(o, "  -J / --jpath <dir>         Specify an additional library search dir")
+	fmt.Fprintln(o, "                             or archive (.zip, .tar, .tar.gz, .tgz)")
 	fmt.Fprintln(o, "                             (right-most wins)")
+	fmt.Fprintln(o, "  --import-map <file>        Resolve import paths using the given import map")
 	fmt.Fprintln(o, "  --version                  Print version")
 	fmt.Fprintln(o)
 	fmt.Fprintln(o, "Environment variables:")
@@ -54,6 +56,7 @@ type config struct {
 	// TODO(sbarzowski) Allow multiple root files checked at once for greater efficiency
 	inputFiles []string
 	evalJpath  []string
+	importMap  string
 }
 
 func makeConfig() config {
@@ -100,6 +103,12 @@ func processArgs(givenArgs []string, config *config, vm *jsonnet.VM) (processArg
 				dir += "/"
 			}
 			config.evalJpath = append(config.evalJpath, dir)
+		} else if arg == "--import-map" {
+			importMap := cmd.NextArg(&i, args)
+			if len(importMap) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--import-map argument was empty string")
+			}
+			config.importMap = importMap
 		} else if len(arg) > 1 && arg[0] == '-' {
 			return processArgsStatusFailure, fmt.Errorf("unrecognized argument: %s", arg)
 		} else {
@@ -155,9 +164,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	vm.Importer(&jsonnet.FileImporter{
-		JPaths: config.evalJpath,
-	})
+	importer, err := cmd.MakeImporter(config.evalJpath, config.importMap)
+	if err != nil {
+		die(err)
+	}
+	vm.Importer(importer)
 
 	var snippets []linter.Snippet
 	for _, inputFile := range config.inputFiles {
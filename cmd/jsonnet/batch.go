@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/google/go-jsonnet"
+)
+
+// batchOutputPath returns the path of the output file for an input file in
+// --batch mode. The directory structure of the inputs is kept, so that e.g.
+// prod/main.jsonnet and dev/main.jsonnet do not overwrite each other.
+func batchOutputPath(vm *jsonnet.VM, config config, inputFile string) (string, error) {
+	relPath := filepath.Clean(inputFile)
+	if filepath.IsAbs(relPath) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		relPath, err = filepath.Rel(wd, relPath)
+		if err != nil {
+			return "", err
+		}
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: --batch input files must be inside the current directory", inputFile)
+	}
+	name := strings.TrimSuffix(relPath, ".jsonnet")
+	if config.evalStream || !vm.StringOutput {
+		// An output extension before .jsonnet is replaced, e.g. a.yaml.jsonnet
+		// with -y is written to a.yaml, not a.yaml.yaml. Other dots are a part
+		// of the name, e.g. env.prod.jsonnet is written to env.prod.json.
+		if outputExtensions[filepath.Ext(name)] {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		if config.evalStream {
+			name += ".yaml"
+		} else {
+			name += ".json"
+		}
+	}
+	return filepath.Join(config.batchOutputDir, name), nil
+}
+
+// outputExtensions are the extensions of the output files in --batch mode,
+// which may be a part of the names of the input files.
+var outputExtensions = map[string]bool{
+	".json": true,
+	".yaml": true,
+	".yml":  true,
+}
+
+// batchOutputPaths returns the paths of the output files for all input files
+// in --batch mode. It fails if two inputs would be written to the same file,
+// e.g. a.json.jsonnet and a.yaml.jsonnet, or a file listed twice.
+func batchOutputPaths(vm *jsonnet.VM, config config) ([]string, error) {
+	outputFiles := make([]string, len(config.inputFiles))
+	inputFiles := make(map[string]string, len(config.inputFiles))
+	for index, inputFile := range config.inputFiles {
+		outputFile, err := batchOutputPath(vm, config, inputFile)
+		if err != nil {
+			return nil, err
+		}
+		if other, taken := inputFiles[outputFile]; taken {
+			return nil, fmt.Errorf("%s and %s would both be written to %s", other, inputFile, outputFile)
+		}
+		inputFiles[outputFile] = inputFile
+		outputFiles[index] = outputFile
+	}
+	return outputFiles, nil
+}
+
+// evaluateBatchFile evaluates a single input file and writes its output.
+func evaluateBatchFile(vm *jsonnet.VM, config config, w *outputWriter, inputFile, outputFile string) error {
+	var output string
+	var err error
+	if config.evalStream {
+		var outputArray []string
+		outputArray, err = vm.EvaluateFileStream(inputFile)
+		output = formatOutputStream(outputArray)
+	} else {
+		output, err = vm.EvaluateFile(inputFile)
+	}
+	if err != nil {
+		return err
+	}
+	return w.write(output, outputFile, true)
+}
+
+// runBatch evaluates all input files in parallel and writes their outputs to
+// the output directory. The files are evaluated by clones of the VM, so they
+// share the cache of imported files. The names of the output files are
+// printed in the order of the inputs. Failures are reported together at the
+// end. It returns false if any file failed.
+func runBatch(vm *jsonnet.VM, config config, w *outputWriter) bool {
+	outputFiles, err := batchOutputPaths(vm, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return false
+	}
+	errs := make([]error, len(config.inputFiles))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < runtime.GOMAXPROCS(0); worker++ {
+		wg.Add(1)
+		go func(vm *jsonnet.VM) {
+			defer wg.Done()
+			for index := range jobs {
+				errs[index] = evaluateBatchFile(vm, config, w, config.inputFiles[index], outputFiles[index])
+			}
+		}(vm.Clone())
+	}
+	for index := range config.inputFiles {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+
+	failures := 0
+	for index, err := range errs {
+		if err != nil {
+			failures++
+			fmt.Fprintf(os.Stderr, "%s: %s\n", config.inputFiles[index], err.Error())
+			continue
+		}
+		if !config.check {
+			fmt.Println(outputFiles[index])
+		}
+	}
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d files failed\n", failures, len(config.inputFiles))
+		return false
+	}
+	return true
+}
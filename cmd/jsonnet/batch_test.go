@@ -0,0 +1,158 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-jsonnet"
+)
+
+// chdir changes the working directory for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBatchOutputPath(t *testing.T) {
+	tests := []struct {
+		name         string
+		inputFile    string
+		stream       bool
+		stringOutput bool
+		outputFile   string
+	}{
+		{"json", "a.jsonnet", false, false, "out/a.json"},
+		{"nested", "prod/main.jsonnet", false, false, "out/prod/main.json"},
+		{"extension", "a.yaml.jsonnet", false, false, "out/a.json"},
+		{"stream extension", "a.yml.jsonnet", true, false, "out/a.yaml"},
+		{"dotted", "env.prod.jsonnet", false, false, "out/env.prod.json"},
+		{"dotted stream", "env.dev.jsonnet", true, false, "out/env.dev.yaml"},
+		{"stream", "a.jsonnet", true, false, "out/a.yaml"},
+		{"string", "a.ini.jsonnet", false, true, "out/a.ini"},
+		{"cleaned", "./dev/../a.jsonnet", false, false, "out/a.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := jsonnet.MakeVM()
+			vm.StringOutput = test.stringOutput
+			config := makeConfig()
+			config.batchOutputDir = "out"
+			config.evalStream = test.stream
+			outputFile, err := batchOutputPath(vm, config, test.inputFile)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if outputFile != filepath.FromSlash(test.outputFile) {
+				t.Errorf("Expected %q, but got %q", filepath.FromSlash(test.outputFile), outputFile)
+			}
+		})
+	}
+}
+
+func TestBatchOutputPathOutsideDirectory(t *testing.T) {
+	config := makeConfig()
+	config.batchOutputDir = "out"
+	_, err := batchOutputPath(jsonnet.MakeVM(), config, "../a.jsonnet")
+	if err == nil || !strings.Contains(err.Error(), "inside the current directory") {
+		t.Errorf("Expected an error about the input outside the current directory, got %v", err)
+	}
+}
+
+func TestBatchOutputPathsCollision(t *testing.T) {
+	tests := []struct {
+		name       string
+		inputFiles []string
+	}{
+		{"extensions", []string{"a.json.jsonnet", "b.jsonnet", "a.yaml.jsonnet"}},
+		{"duplicate", []string{"a.jsonnet", "a.jsonnet"}},
+		{"same file", []string{"a.jsonnet", "./a.jsonnet"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := makeConfig()
+			config.batchOutputDir = "out"
+			config.inputFiles = test.inputFiles
+			_, err := batchOutputPaths(jsonnet.MakeVM(), config)
+			if err == nil || !strings.Contains(err.Error(), "would both be written to") {
+				t.Errorf("Expected an error about the collision, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	if err := os.Mkdir("prod", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, "a.jsonnet", `{ a: 1 }`)
+	writeTestFile(t, filepath.Join("prod", "a.jsonnet"), `{ a: 2 }`)
+	writeTestFile(t, "env.prod.jsonnet", `{ env: "prod" }`)
+	writeTestFile(t, "env.dev.jsonnet", `{ env: "dev" }`)
+
+	config := makeConfig()
+	config.batch = true
+	config.batchOutputDir = "out"
+	config.inputFiles = []string{"a.jsonnet", filepath.Join("prod", "a.jsonnet"), "env.prod.jsonnet", "env.dev.jsonnet"}
+	if !runBatch(jsonnet.MakeVM(), config, &outputWriter{}) {
+		t.Fatal("Expected the batch to succeed")
+	}
+	expected := map[string]string{
+		filepath.Join("out", "a.json"):         "{\n   \"a\": 1\n}\n",
+		filepath.Join("out", "prod", "a.json"): "{\n   \"a\": 2\n}\n",
+		filepath.Join("out", "env.prod.json"):  "{\n   \"env\": \"prod\"\n}\n",
+		filepath.Join("out", "env.dev.json"):   "{\n   \"env\": \"dev\"\n}\n",
+	}
+	actual := make(map[string]string)
+	for outputFile := range expected {
+		content, err := os.ReadFile(outputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual[outputFile] = string(content)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %q, but got %q", expected, actual)
+	}
+
+	// Nothing is evaluated or written if the outputs collide.
+	config.batchOutputDir = "collision"
+	config.inputFiles = []string{"a.jsonnet", "a.jsonnet"}
+	if runBatch(jsonnet.MakeVM(), config, &outputWriter{}) {
+		t.Error("Expected the batch to fail")
+	}
+	if _, err := os.Stat("collision"); !os.IsNotExist(err) {
+		t.Errorf("Expected no output, got %v", err)
+	}
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/fatih/color"
 
@@ -38,12 +43,18 @@ func usage(o io.Writer) {
 	version(o)
 	fmt.Fprintln(o)
 	fmt.Fprintln(o, "jsonnet {<option>} <filename>")
+	fmt.Fprintln(o, "jsonnet --batch {<option>} --output-dir <dir> <filename>...")
+	fmt.Fprintln(o, "jsonnet explain {<option>} --path <path> <filename>")
 	fmt.Fprintln(o)
 	fmt.Fprintln(o, "Available options:")
 	fmt.Fprintln(o, "  -h / --help                This message")
 	fmt.Fprintln(o, "  -e / --exec                Treat filename as code")
 	fmt.Fprintln(o, "  -J / --jpath <dir>         Specify an additional library search dir")
+	fmt.Fprintln(o, "                             or archive (.zip, .tar, .tar.gz, .tgz)")
 	fmt.Fprintln(o, "                             (right-most wins)")
+	fmt.Fprintln(o, "  --import-map <file>        Resolve import paths using the given import map")
+	fmt.Fprintln(o, "  --lockfile <file>          Verify the hashes of the imported files against")
+	fmt.Fprintln(o, "                             the lockfile (see jsonnet-deps --write-lockfile)")
 	fmt.Fprintln(o, "  -o / --output-file <file>  Write to the output file rather than stdout")
 	fmt.Fprintln(o, "  -m / --multi <dir>         Write multiple files to the directory, list files")
 	fmt.Fprintln(o, "                             on stdout")
@@ -53,6 +64,27 @@ func usage(o io.Writer) {
 	fmt.Fprintln(o, "  -S / --string              Expect a string, manifest as plain text")
 	fmt.Fprintln(o, "  -s / --max-stack <n>       Number of allowed stack frames")
 	fmt.Fprintln(o, "  -t / --max-trace <n>       Max length of stack trace before cropping")
+	fmt.Fprintln(o, "  --watch                    Evaluate again whenever one of the imported files")
+	fmt.Fprintln(o, "                             changes. Missing imports and new files which would")
+	fmt.Fprintln(o, "                             shadow an import found in a later --jpath are not")
+	fmt.Fprintln(o, "                             watched")
+	fmt.Fprintln(o, "  --batch                    Evaluate multiple files in parallel, writing the")
+	fmt.Fprintln(o, "                             outputs to the --output-dir (.json, .yaml with -y,")
+	fmt.Fprintln(o, "                             or just without .jsonnet with -S)")
+	fmt.Fprintln(o, "  --output-dir <dir>         Output directory for --batch")
+	fmt.Fprintln(o, "  --check                    Do not write the output files, print a diff for")
+	fmt.Fprintln(o, "                             each one which is not up to date and fail if")
+	fmt.Fprintln(o, "                             there are any")
+	fmt.Fprintln(o, "  --source-map <file>        Write a JSON file mapping each field of the output")
+	fmt.Fprintln(o, "                             to the locations which define and override it")
+	fmt.Fprintln(o, "  --profile <file>           Write a profile of the evaluated Jsonnet code for")
+	fmt.Fprintln(o, "                             go tool pprof")
+	fmt.Fprintln(o, "  --coverage <file>          Write the line and branch coverage of the")
+	fmt.Fprintln(o, "                             evaluated Jsonnet code")
+	fmt.Fprintln(o, "  --coverage-format <format> Format of --coverage, lcov (default) or go")
+	fmt.Fprintln(o, "  --path <path>              Field to explain (explain only), either dotted,")
+	fmt.Fprintln(o, "                             e.g. spec.containers.0.image, or a JSON pointer")
+	fmt.Fprintln(o, "                             like in --source-map, e.g. /a.b/c")
 	fmt.Fprintln(o, "  --version                  Print version")
 	fmt.Fprintln(o)
 	fmt.Fprintln(o, "Available options for specifying values of 'external' variables:")
@@ -94,18 +126,31 @@ func usage(o io.Writer) {
 type config struct {
 	outputFile           string
 	evalMultiOutputDir   string
+	batchOutputDir       string
+	importMap            string
+	lockfile             string
+	sourceMap            string
+	explainPath          string
+	profile              string
+	coverage             string
+	coverageFormat       string
 	inputFiles           []string
 	evalJpath            []string
 	filenameIsCode       bool
 	evalMulti            bool
 	evalStream           bool
 	evalCreateOutputDirs bool
+	watch                bool
+	batch                bool
+	check                bool
+	explain              bool
 }
 
 func makeConfig() config {
 	return config{
 		filenameIsCode: false,
 		evalMulti:      false,
+		coverageFormat: "lcov",
 		evalStream:     false,
 		evalJpath:      []string{},
 	}
@@ -147,6 +192,10 @@ func processArgs(givenArgs []string, config *config, vm *jsonnet.VM) (processArg
 	args := cmd.SimplifyArgs(givenArgs)
 	remainingArgs := make([]string, 0, len(args))
 	i := 0
+	if len(args) > 0 && args[0] == "explain" {
+		config.explain = true
+		i++
+	}
 
 	handleVarVal := func(handle func(key string, val string)) error {
 		next := cmd.NextArg(&i, args)
@@ -202,6 +251,18 @@ func processArgs(givenArgs []string, config *config, vm *jsonnet.VM) (processArg
 				return processArgsStatusFailure, fmt.Errorf("-J argument was empty string")
 			}
 			config.evalJpath = append(config.evalJpath, dir)
+		} else if arg == "--import-map" {
+			importMap := cmd.NextArg(&i, args)
+			if len(importMap) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--import-map argument was empty string")
+			}
+			config.importMap = importMap
+		} else if arg == "--lockfile" {
+			lockfile := cmd.NextArg(&i, args)
+			if len(lockfile) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--lockfile argument was empty string")
+			}
+			config.lockfile = lockfile
 		} else if arg == "-V" || arg == "--ext-str" {
 			if err := handleVarVal(vm.ExtVar); err != nil {
 				return processArgsStatusFailure, err
@@ -256,6 +317,48 @@ func processArgs(givenArgs []string, config *config, vm *jsonnet.VM) (processArg
 			config.evalStream = true
 		} else if arg == "-S" || arg == "--string" {
 			vm.StringOutput = true
+		} else if arg == "--watch" {
+			config.watch = true
+		} else if arg == "--batch" {
+			config.batch = true
+		} else if arg == "--check" {
+			config.check = true
+		} else if arg == "--source-map" {
+			sourceMap := cmd.NextArg(&i, args)
+			if len(sourceMap) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--source-map argument was empty string")
+			}
+			config.sourceMap = sourceMap
+		} else if arg == "--profile" {
+			profile := cmd.NextArg(&i, args)
+			if len(profile) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--profile argument was empty string")
+			}
+			config.profile = profile
+		} else if arg == "--coverage" {
+			coverage := cmd.NextArg(&i, args)
+			if len(coverage) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--coverage argument was empty string")
+			}
+			config.coverage = coverage
+		} else if arg == "--coverage-format" {
+			format := cmd.NextArg(&i, args)
+			if format != "lcov" && format != "go" {
+				return processArgsStatusFailure, fmt.Errorf("--coverage-format must be lcov or go, got %#v", format)
+			}
+			config.coverageFormat = format
+		} else if arg == "--path" {
+			path := cmd.NextArg(&i, args)
+			if len(path) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--path argument was empty string")
+			}
+			config.explainPath = path
+		} else if arg == "--output-dir" {
+			outputDir := cmd.NextArg(&i, args)
+			if len(outputDir) == 0 {
+				return processArgsStatusFailure, fmt.Errorf("--output-dir argument was empty string")
+			}
+			config.batchOutputDir = outputDir
 		} else if len(arg) > 1 && arg[0] == '-' {
 			return processArgsStatusFailure, fmt.Errorf("unrecognized argument: %s", arg)
 		} else {
@@ -272,7 +375,47 @@ func processArgs(givenArgs []string, config *config, vm *jsonnet.VM) (processArg
 	}
 
 	// TODO(dcunnin): Formatter allows multiple files in test and in-place mode.
-	multipleFilesAllowed := false
+	multipleFilesAllowed := config.batch
+
+	if config.batch {
+		if config.batchOutputDir == "" {
+			return processArgsStatusFailure, fmt.Errorf("--batch requires --output-dir")
+		}
+		if config.filenameIsCode || config.evalMulti || config.outputFile != "" || config.watch {
+			return processArgsStatusFailure, fmt.Errorf("--batch cannot be used with -e, -m, -o or --watch")
+		}
+	} else if config.batchOutputDir != "" {
+		return processArgsStatusFailure, fmt.Errorf("--output-dir can only be used with --batch")
+	}
+	if config.explain {
+		if config.explainPath == "" {
+			return processArgsStatusFailure, fmt.Errorf("explain requires --path")
+		}
+		if config.evalMulti || config.evalStream || vm.StringOutput || config.outputFile != "" || config.batch || config.watch || config.check || config.sourceMap != "" {
+			return processArgsStatusFailure, fmt.Errorf("explain cannot be used with -m, -y, -S, -o, --batch, --watch, --check or --source-map")
+		}
+	} else if config.explainPath != "" {
+		return processArgsStatusFailure, fmt.Errorf("--path can only be used with explain")
+	}
+	if config.profile != "" && (config.batch || config.watch) {
+		return processArgsStatusFailure, fmt.Errorf("--profile cannot be used with --batch or --watch")
+	}
+	if config.coverage != "" && (config.batch || config.watch) {
+		return processArgsStatusFailure, fmt.Errorf("--coverage cannot be used with --batch or --watch")
+	}
+	if config.sourceMap != "" {
+		if config.evalMulti || config.evalStream || vm.StringOutput || config.batch {
+			return processArgsStatusFailure, fmt.Errorf("--source-map cannot be used with -m, -y, -S or --batch")
+		}
+	}
+	if config.check {
+		if config.outputFile == "" && !config.evalMulti && !config.batch {
+			return processArgsStatusFailure, fmt.Errorf("--check requires -o, -m or --batch")
+		}
+		if config.watch {
+			return processArgsStatusFailure, fmt.Errorf("--check cannot be used with --watch")
+		}
+	}
 
 	if !multipleFilesAllowed {
 		if len(remainingArgs) > 1 {
@@ -284,26 +427,63 @@ func processArgs(givenArgs []string, config *config, vm *jsonnet.VM) (processArg
 	return processArgsStatusContinue, nil
 }
 
-func writeMultiOutputFiles(output map[string]string, outputDir, outputFile string, createDirs bool) (err error) {
-	// If multiple file output is used, then iterate over each string from
-	// the sequence of strings returned by jsonnet_evaluate_snippet_multi,
-	// construct pairs of filename and content, and write each output file.
+// outputWriter writes the outputs. In --check mode it does not write the
+// files, but prints a diff for each one which is not up to date.
+type outputWriter struct {
+	// mu protects stale, the outputs may be written by --batch workers.
+	mu    sync.Mutex
+	stale int
+	check bool
+	// watch makes write skip the files whose content does not change.
+	watch bool
+}
 
-	var manifest *os.File
+// write writes the output to stdout or to outputFile. In --watch mode the
+// file is only written if its content changes.
+func (w *outputWriter) write(output, outputFile string, createDirs bool) error {
+	return w.writeFile(output, outputFile, createDirs, w.watch)
+}
 
+// writeFile is like write, but skipUnchanged tells whether the file is only
+// written if its content changes. This way its timestamp is not bumped,
+// which may trigger other tools (e.g. make) to do unnecessary work.
+func (w *outputWriter) writeFile(output, outputFile string, createDirs, skipUnchanged bool) error {
 	if outputFile == "" {
-		manifest = os.Stdout
-	} else {
-		manifest, err = os.Create(outputFile)
+		if !w.check {
+			fmt.Print(output)
+		}
+		return nil
+	}
+	if !w.check && !skipUnchanged {
+		return cmd.WriteOutputFile(output, outputFile, createDirs)
+	}
+	existingContent, err := os.ReadFile(outputFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && string(existingContent) == output {
+		return nil
+	}
+	if w.check {
+		oldName := outputFile
 		if err != nil {
-			return err
+			oldName = "/dev/null"
 		}
-		defer func() {
-			if ferr := manifest.Close(); ferr != nil {
-				err = ferr
-			}
-		}()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.stale++
+		fmt.Print(cmd.UnifiedDiff(oldName, outputFile, string(existingContent), output))
+		return nil
 	}
+	return cmd.WriteOutputFile(output, outputFile, createDirs)
+}
+
+func writeMultiOutputFiles(w *outputWriter, output map[string]string, outputDir, outputFile string, createDirs bool) error {
+	// If multiple file output is used, then iterate over each string from
+	// the sequence of strings returned by jsonnet_evaluate_snippet_multi,
+	// construct pairs of filename and content, and write each output file.
+
+	var manifest strings.Builder
 
 	// Iterate through the map in order.
 	keys := make([]string, 0, len(output))
@@ -312,83 +492,84 @@ func writeMultiOutputFiles(output map[string]string, outputDir, outputFile strin
 	}
 	sort.Strings(keys)
 	for _, key := range keys {
-		newContent := output[key]
 		filename := outputDir + key
-
-		_, err := manifest.WriteString(filename)
-		if err != nil {
-			return err
-		}
-
-		_, err = manifest.WriteString("\n")
-		if err != nil {
+		manifest.WriteString(filename)
+		manifest.WriteString("\n")
+		// The files of -m are always skipped if they are unchanged.
+		if err := w.writeFile(output[key], filename, createDirs, true); err != nil {
 			return err
 		}
+	}
 
-		if _, err := os.Stat(filename); !os.IsNotExist(err) {
-			existingContent, err := os.ReadFile(filename)
-			if err != nil {
-				return err
-			}
-			if string(existingContent) == newContent {
-				// Do not bump the timestamp on the file if its content is
-				// the same. This may trigger other tools (e.g. make) to do
-				// unnecessary work.
-				continue
-			}
-		}
-		if createDirs {
-			if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
-				return err
-			}
-		}
+	return w.write(manifest.String(), outputFile, false)
+}
 
-		err = os.WriteFile(filename, []byte(newContent), 0666)
-		if err != nil {
-			return err
-		}
+// formatOutputStream formats the output as a YAML stream.
+func formatOutputStream(output []string) string {
+	var stream strings.Builder
+	for _, doc := range output {
+		stream.WriteString("---\n")
+		stream.WriteString(doc)
 	}
-
-	return nil
+	if len(output) > 0 {
+		stream.WriteString("...\n")
+	}
+	return stream.String()
 }
 
 // writeOutputStream writes the output as a YAML stream.
-func writeOutputStream(output []string, outputFile string) (err error) {
-	var f *os.File
+func writeOutputStream(w *outputWriter, output []string, outputFile string) error {
+	return w.write(formatOutputStream(output), outputFile, false)
+}
 
-	if outputFile == "" {
-		f = os.Stdout
+// run evaluates the input and writes the output.
+func run(vm *jsonnet.VM, config config, w *outputWriter, filename, input string) error {
+	var output string
+	var outputArray []string
+	var outputDict map[string]string
+	var sourceMap jsonnet.SourceMap
+	var err error
+	if config.filenameIsCode || config.inputFiles[0] == "-" {
+		if config.evalMulti {
+			outputDict, err = vm.EvaluateAnonymousSnippetMulti(filename, input)
+		} else if config.evalStream {
+			outputArray, err = vm.EvaluateAnonymousSnippetStream(filename, input)
+		} else if config.sourceMap != "" {
+			output, sourceMap, err = vm.EvaluateAnonymousSnippetSourceMap(filename, input)
+		} else {
+			output, err = vm.EvaluateAnonymousSnippet(filename, input)
+		}
 	} else {
-		f, err = os.Create(outputFile)
-		if err != nil {
-			return err
+		if config.evalMulti {
+			outputDict, err = vm.EvaluateFileMulti(filename)
+		} else if config.evalStream {
+			outputArray, err = vm.EvaluateFileStream(filename)
+		} else if config.sourceMap != "" {
+			output, sourceMap, err = vm.EvaluateFileSourceMap(filename)
+		} else {
+			output, err = vm.EvaluateFile(filename)
 		}
-		defer func() {
-			if ferr := f.Close(); ferr != nil {
-				err = ferr
-			}
-		}()
+	}
+	if err != nil {
+		return err
 	}
 
-	for _, doc := range output {
-		_, err := f.WriteString("---\n")
-		if err != nil {
-			return err
-		}
-		_, err = f.WriteString(doc)
+	// Write output JSON.
+	if config.evalMulti {
+		return writeMultiOutputFiles(w, outputDict, config.evalMultiOutputDir, config.outputFile, config.evalCreateOutputDirs)
+	} else if config.evalStream {
+		return writeOutputStream(w, outputArray, config.outputFile)
+	}
+	if config.sourceMap != "" {
+		data, err := json.MarshalIndent(sourceMap, "", "  ")
 		if err != nil {
 			return err
 		}
-	}
-
-	if len(output) > 0 {
-		_, err := f.WriteString("...\n")
-		if err != nil {
+		if err := w.write(string(data)+"\n", config.sourceMap, config.evalCreateOutputDirs); err != nil {
 			return err
 		}
 	}
-
-	return nil
+	return w.write(output, config.outputFile, config.evalCreateOutputDirs)
 }
 
 func main() {
@@ -426,9 +607,42 @@ func main() {
 		os.Exit(1)
 	}
 
-	vm.Importer(&jsonnet.FileImporter{
-		JPaths: config.evalJpath,
-	})
+	importer, err := cmd.MakeImporter(config.evalJpath, config.importMap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	vm.Importer(importer)
+
+	if config.lockfile != "" {
+		lockfile, err := jsonnet.LoadLockfile(config.lockfile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		vm.Lockfile(lockfile, jsonnet.LockfileVerify)
+	}
+
+	var profiler *jsonnet.Profiler
+	if config.profile != "" {
+		profiler = jsonnet.NewProfiler()
+		vm.Profile(profiler)
+	}
+	var coverage *jsonnet.Coverage
+	if config.coverage != "" {
+		coverage = jsonnet.NewCoverage()
+		vm.Coverage(coverage)
+	}
+
+	w := &outputWriter{check: config.check, watch: config.watch}
+	if config.batch {
+		ok := runBatch(vm, config, w)
+		checkStale(w)
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
 
 	if len(config.inputFiles) != 1 {
 		// Should already have been caught by processArgs.
@@ -437,53 +651,84 @@ func main() {
 	filename := config.inputFiles[0]
 	// TODO(sbarzowski) Clean up SafeReadInput to be more in line with the new API
 	input := cmd.SafeReadInput(config.filenameIsCode, &filename)
-	var output string
-	var outputArray []string
-	var outputDict map[string]string
-	if config.filenameIsCode || config.inputFiles[0] == "-" {
-		if config.evalMulti {
-			outputDict, err = vm.EvaluateAnonymousSnippetMulti(filename, input)
-		} else if config.evalStream {
-			outputArray, err = vm.EvaluateAnonymousSnippetStream(filename, input)
-		} else {
-			output, err = vm.EvaluateAnonymousSnippet(filename, input)
-		}
-	} else {
-		if config.evalMulti {
-			outputDict, err = vm.EvaluateFileMulti(filename)
-		} else if config.evalStream {
-			outputArray, err = vm.EvaluateFileStream(filename)
-		} else {
-			output, err = vm.EvaluateFile(filename)
+
+	if config.explain {
+		err := explain(os.Stdout, vm, config, filename, input)
+		writeProfile(profiler, config.profile)
+		writeCoverage(coverage, config.coverage, config.coverageFormat)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
 		}
+		return
 	}
 
-	cmd.MemProfile()
+	if config.watch {
+		// Watch until interrupted, then exit normally.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		watch(ctx, vm, watchInterval, func() error {
+			return run(vm, config, w, filename, input)
+		})
+		return
+	}
 
+	err = run(vm, config, w, filename, input)
+	cmd.MemProfile()
+	writeProfile(profiler, config.profile)
+	writeCoverage(coverage, config.coverage, config.coverageFormat)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
+	checkStale(w)
+}
 
-	// Write output JSON.
-	if config.evalMulti {
-		err := writeMultiOutputFiles(outputDict, config.evalMultiOutputDir, config.outputFile, config.evalCreateOutputDirs)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+// writeProfile writes the --profile file, also if the evaluation failed.
+func writeProfile(profiler *jsonnet.Profiler, filename string) {
+	if profiler == nil {
+		return
+	}
+	f, err := os.Create(filename)
+	if err == nil {
+		err = profiler.Write(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
 		}
-	} else if config.evalStream {
-		err := writeOutputStream(outputArray, config.outputFile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write profile: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// writeCoverage writes the --coverage file, also if the evaluation failed.
+func writeCoverage(coverage *jsonnet.Coverage, filename, format string) {
+	if coverage == nil {
+		return
+	}
+	f, err := os.Create(filename)
+	if err == nil {
+		if format == "go" {
+			err = coverage.WriteGoCover(f)
+		} else {
+			err = coverage.WriteLCOV(f)
 		}
-	} else {
-		err := cmd.WriteOutputFile(output, config.outputFile, config.evalCreateOutputDirs)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
 		}
 	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write coverage: %v\n", err)
+		os.Exit(1)
+	}
+}
 
+// checkStale exits with an error if --check found outputs which are not
+// up to date.
+func checkStale(w *outputWriter) {
+	if w.stale > 0 {
+		fmt.Fprintf(os.Stderr, "%d output file(s) not up to date\n", w.stale)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,83 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutputWriterSkipsUnchanged(t *testing.T) {
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		w           *outputWriter
+		multi       bool
+		expectWrite bool
+	}{
+		{"plain", &outputWriter{}, false, true},
+		{"watch", &outputWriter{watch: true}, false, false},
+		{"multi", &outputWriter{}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outputFile := filepath.Join(dir, "out.json")
+			writeTestFile(t, outputFile, "{ }\n")
+			if err := os.Chtimes(outputFile, old, old); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			if test.multi {
+				err = writeMultiOutputFiles(test.w, map[string]string{"out.json": "{ }\n"}, dir+"/", filepath.Join(dir, "manifest"), false)
+			} else {
+				err = test.w.write("{ }\n", outputFile, false)
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			info, err := os.Stat(outputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written := !info.ModTime().Equal(old); written != test.expectWrite {
+				t.Errorf("Expected the file to be written: %v, but it was: %v", test.expectWrite, written)
+			}
+		})
+	}
+}
+
+func TestOutputWriterWritesChanged(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "dir", "out.json")
+	w := &outputWriter{watch: true}
+	for _, output := range []string{"1\n", "2\n"} {
+		if err := w.write(output, outputFile, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		content, err := os.ReadFile(outputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != output {
+			t.Errorf("Expected %q, but got %q", output, string(content))
+		}
+	}
+}
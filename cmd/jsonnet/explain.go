@@ -0,0 +1,218 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+)
+
+var identifierRegexp = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+
+// explain prints the layers of the + chain which define the field at
+// config.explainPath, e.g. "spec.containers.0.image".
+func explain(out io.Writer, vm *jsonnet.VM, config config, filename, input string) error {
+	path, err := parseExplainPath(config.explainPath)
+	if err != nil {
+		return err
+	}
+
+	var parent *jsonnet.Value
+	if config.filenameIsCode || config.inputFiles[0] == "-" {
+		parent, err = vm.EvaluateAnonymousSnippetLazy(filename, input)
+	} else {
+		parent, err = vm.EvaluateFileLazy(filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	for index, name := range path.names[:len(path.names)-1] {
+		parent, err = explainStep(parent, path.prefix(index), name)
+		if err != nil {
+			return err
+		}
+	}
+	name := path.names[len(path.names)-1]
+	if t, err := parent.Type(); err != nil {
+		return err
+	} else if t != "object" {
+		return fmt.Errorf("%s is not an object, but %s", path.prefix(len(path.names)-1), withArticle(t))
+	}
+	layers, err := parent.Explain(name)
+	if err != nil {
+		return err
+	}
+
+	field, err := parent.Field(name)
+	if err == nil {
+		fmt.Fprintf(out, "%s = %s\n", config.explainPath, formatValue(field, nil, ""))
+	} else {
+		fmt.Fprintf(out, "%s\n", err.Error())
+	}
+	for index, layer := range layers {
+		location := "(no source location)"
+		if layer.Location != nil {
+			location = layer.Location.String()
+		}
+		if layer.UsesSuper {
+			location += " (uses super)"
+		}
+		fmt.Fprintf(out, "\nLayer %d: %s\n", index+1, location)
+		fmt.Fprintf(out, "  %s%s %s\n", formatFieldName(name), fieldSeparator(layer), formatValue(layer.Value, layer.Err, "  "))
+	}
+	return nil
+}
+
+// explainPath is a parsed --path of explain.
+type explainPath struct {
+	// names are the field names and array indexes on the path.
+	names []string
+	// pointer is true if the path was given as a JSON pointer.
+	pointer bool
+}
+
+var (
+	jsonPointerEscaper       = strings.NewReplacer("~", "~0", "/", "~1")
+	jsonPointerUnescaper     = strings.NewReplacer("~1", "/", "~0", "~")
+	invalidJSONPointerEscape = regexp.MustCompile(`~([^01]|$)`)
+)
+
+// parseExplainPath parses a path which is either a JSON pointer (RFC 6901)
+// like the paths in --source-map, e.g. "/metadata/annotations/app.kubernetes.io~1name",
+// or field names and array indexes separated by dots, e.g. "spec.containers.0.image".
+// Field names which contain dots can only be given in a JSON pointer.
+func parseExplainPath(path string) (explainPath, error) {
+	if strings.HasPrefix(path, "/") {
+		names := strings.Split(path[1:], "/")
+		for index, name := range names {
+			if invalidJSONPointerEscape.MatchString(name) {
+				return explainPath{}, fmt.Errorf("invalid JSON pointer %#v: ~ must be escaped as ~0", path)
+			}
+			names[index] = jsonPointerUnescaper.Replace(name)
+		}
+		return explainPath{names: names, pointer: true}, nil
+	}
+	names := strings.Split(path, ".")
+	for _, name := range names {
+		if name == "" {
+			return explainPath{}, fmt.Errorf("invalid path %#v: empty field name, use a JSON pointer like /a.b/c for field names with dots", path)
+		}
+	}
+	return explainPath{names: names}, nil
+}
+
+// prefix formats the first n names of the path for error messages, in the
+// same syntax as the path was given.
+func (path explainPath) prefix(n int) string {
+	if n == 0 {
+		return "the top-level value"
+	}
+	if path.pointer {
+		var prefix strings.Builder
+		for _, name := range path.names[:n] {
+			prefix.WriteString("/")
+			prefix.WriteString(jsonPointerEscaper.Replace(name))
+		}
+		return prefix.String()
+	}
+	return strings.Join(path.names[:n], ".")
+}
+
+// explainStep goes to an array element or object field on the path.
+// The parent is described by parentPath in the error messages.
+func explainStep(parent *jsonnet.Value, parentPath, name string) (*jsonnet.Value, error) {
+	t, err := parent.Type()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case "array":
+		index, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, fmt.Errorf("%#v is not a valid index of the array %s", name, parentPath)
+		}
+		return parent.Index(index)
+	case "object":
+		return parent.Field(name)
+	}
+	return nil, fmt.Errorf("%s is not an object or array, but %s", parentPath, withArticle(t))
+}
+
+// withArticle returns a type name with the indefinite article, e.g.
+// "an array".
+func withArticle(t string) string {
+	if strings.ContainsAny(t[:1], "aeiou") {
+		return "an " + t
+	}
+	return "a " + t
+}
+
+func formatFieldName(name string) string {
+	if identifierRegexp.MatchString(name) {
+		return name
+	}
+	quoted, _ := json.Marshal(name)
+	return string(quoted)
+}
+
+func fieldSeparator(layer jsonnet.FieldLayer) string {
+	separator := ""
+	if layer.PlusSuper {
+		separator = "+"
+	}
+	switch layer.Hide {
+	case ast.ObjectFieldHidden:
+		return separator + "::"
+	case ast.ObjectFieldVisible:
+		return separator + ":::"
+	}
+	return separator + ":"
+}
+
+// formatValue formats a value as indented JSON, or the message of the error
+// which prevented it from being evaluated. The value of a layer may fail on
+// its own, e.g. if it is an object whose fields use super.
+func formatValue(value *jsonnet.Value, err error, indent string) string {
+	if err == nil {
+		var t string
+		t, err = value.Type()
+		if err == nil && t == "function" {
+			return "<function>"
+		}
+	}
+	var manifested interface{}
+	if err == nil {
+		manifested, err = value.Manifest()
+	}
+	if err == nil {
+		var data []byte
+		data, err = json.MarshalIndent(manifested, indent, "   ")
+		if err == nil {
+			return string(data)
+		}
+	}
+	message, _, _ := strings.Cut(err.Error(), "\n")
+	return "<" + message + ">"
+}
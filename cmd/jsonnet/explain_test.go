@@ -0,0 +1,130 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-jsonnet"
+)
+
+func TestParseExplainPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		names []string
+	}{
+		{"a", []string{"a"}},
+		{"spec.containers.0.image", []string{"spec", "containers", "0", "image"}},
+		{"/spec/containers/0/image", []string{"spec", "containers", "0", "image"}},
+		{"/metadata/app.kubernetes.io~1name", []string{"metadata", "app.kubernetes.io/name"}},
+		{"/a~0b/", []string{"a~b", ""}},
+	}
+	for _, test := range tests {
+		path, err := parseExplainPath(test.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(path.names, test.names) {
+			t.Errorf("%s: expected %q, but got %q", test.path, test.names, path.names)
+		}
+	}
+
+	for _, path := range []string{"a..b", "a.", "/a~2", "/a~"} {
+		if _, err := parseExplainPath(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	const input = `{ a: { b: 1, "c.d": 2 }, l: [{ e: 3 }] } + { a+: { "c.d": 4 } }`
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"a.b", "a.b = 1\n\nLayer 1: explain:1:8-12\n  b: 1\n"},
+		{"/a/c.d", "/a/c.d = 4\n\nLayer 1: explain:1:14-22\n  \"c.d\": 2\n\nLayer 2: explain:1:52-60\n  \"c.d\": 4\n"},
+		{"l.0.e", "l.0.e = 3\n\nLayer 1: explain:1:32-36\n  e: 3\n"},
+	}
+	for _, test := range tests {
+		config := makeConfig()
+		config.filenameIsCode = true
+		config.explainPath = test.path
+		var out bytes.Buffer
+		if err := explain(&out, jsonnet.MakeVM(), config, "explain", input); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.path, err)
+			continue
+		}
+		if out.String() != test.expected {
+			t.Errorf("%s: expected %q, but got %q", test.path, test.expected, out.String())
+		}
+	}
+}
+
+func TestExplainErrors(t *testing.T) {
+	const input = `{ a: { b: { c: 1 } }, l: [1] }`
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"a.b.c.d", "a.b.c is not an object, but a number"},
+		{"a.b.c.d.e", "a.b.c is not an object or array, but a number"},
+		{"/a/b/c/d", "/a/b/c is not an object, but a number"},
+		{"l.x.y", `"x" is not a valid index of the array l`},
+		{"l.0", "l is not an object, but an array"},
+	}
+	for _, test := range tests {
+		config := makeConfig()
+		config.filenameIsCode = true
+		config.explainPath = test.path
+		err := explain(&bytes.Buffer{}, jsonnet.MakeVM(), config, "explain", input)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error %q, got %v", test.path, test.expected, err)
+		}
+	}
+}
+
+func TestExplainArgs(t *testing.T) {
+	config := makeConfig()
+	status, err := processArgs([]string{"explain", "--path", "/a.b/c", "main.jsonnet"}, &config, jsonnet.MakeVM())
+	if err != nil || status != processArgsStatusContinue {
+		t.Fatalf("unexpected status %v, error %v", status, err)
+	}
+	if !config.explain || config.explainPath != "/a.b/c" {
+		t.Errorf("expected explain of /a.b/c, got %v of %#v", config.explain, config.explainPath)
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"explain", "main.jsonnet"}, "explain requires --path"},
+		{[]string{"--path", "a", "main.jsonnet"}, "--path can only be used with explain"},
+		{[]string{"explain", "--path", "a", "-y", "main.jsonnet"}, "explain cannot be used with"},
+	}
+	for _, test := range tests {
+		config := makeConfig()
+		_, err := processArgs(test.args, &config, jsonnet.MakeVM())
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected an error %q, got %v", test.args, test.expected, err)
+		}
+	}
+}
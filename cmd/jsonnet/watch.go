@@ -0,0 +1,81 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-jsonnet"
+)
+
+const watchInterval = 500 * time.Millisecond
+
+// fileState identifies a version of a file. Files inside archives have
+// the state of the archive.
+func fileState(p string) string {
+	for {
+		info, err := os.Stat(p)
+		if err == nil {
+			return fmt.Sprintf("%s %v %d", p, info.ModTime(), info.Size())
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return ""
+		}
+		p = parent
+	}
+}
+
+// watch calls run and then calls it again every time one of the files
+// imported by the VM changes, which is checked every interval. Imports
+// which were not found are not watched, so creating them does not trigger
+// a run. It only returns when the context is done.
+func watch(ctx context.Context, vm *jsonnet.VM, interval time.Duration, run func() error) {
+	for {
+		states := make(map[string]string)
+		for _, file := range vm.ImportedFiles() {
+			states[file] = fileState(file)
+		}
+		if err := run(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		// Files imported for the first time during this run are watched too.
+		for _, file := range vm.ImportedFiles() {
+			if _, known := states[file]; !known {
+				states[file] = fileState(file)
+			}
+		}
+
+		for changed := false; !changed; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			for file, state := range states {
+				if fileState(file) != state {
+					vm.InvalidateImport(file)
+					changed = true
+				}
+			}
+		}
+	}
+}
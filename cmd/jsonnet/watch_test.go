@@ -0,0 +1,86 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-jsonnet"
+)
+
+func writeTestFile(t *testing.T, filename, content string) {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	mainFile := filepath.Join(dir, "main.jsonnet")
+	libFile := filepath.Join(dir, "lib.libsonnet")
+	writeTestFile(t, mainFile, `import "lib.libsonnet"`)
+	writeTestFile(t, libFile, `1`)
+
+	vm := jsonnet.MakeVM()
+	ctx, cancel := context.WithCancel(context.Background())
+	outputs := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watch(ctx, vm, 10*time.Millisecond, func() error {
+			output, err := vm.EvaluateFile(mainFile)
+			if err != nil {
+				output = err.Error()
+			}
+			select {
+			case outputs <- output:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	}()
+	next := func() string {
+		select {
+		case output := <-outputs:
+			return output
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the evaluation")
+			return ""
+		}
+	}
+
+	if output := next(); output != "1\n" {
+		t.Errorf("Expected %q, but got %q", "1\n", output)
+	}
+	// The size changes too, in case the timestamps are coarse.
+	writeTestFile(t, libFile, `22`)
+	if output := next(); output != "22\n" {
+		t.Errorf("Expected %q, but got %q", "22\n", output)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not return after the context was canceled")
+	}
+}
@@ -0,0 +1,1024 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/google/go-jsonnet/ast"
+)
+
+// Conversions between the standard Go representation of JSON
+// (as in "encoding/json" package) and arbitrary Go types. They follow the
+// rules of encoding/json, but they work on the values directly instead of
+// going through the JSON text.
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	jsonNumberType      = reflect.TypeOf(json.Number(""))
+)
+
+// structField is a field of a struct type, as it is seen by encoding/json.
+type structField struct {
+	name string
+	// index is the path to the field through the embedded structs, see
+	// reflect.Value.FieldByIndex.
+	index     []int
+	tagged    bool
+	omitEmpty bool
+	// quoted is set by the ",string" option on scalar fields.
+	quoted bool
+}
+
+var structFieldsCache sync.Map // map[reflect.Type][]structField
+
+// structFields returns the fields of the struct type t which encoding/json
+// would use, including the fields promoted from the embedded structs.
+func structFields(t reflect.Type) []structField {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.([]structField)
+	}
+	fields, _ := structFieldsCache.LoadOrStore(t, typeFields(t))
+	return fields.([]structField)
+}
+
+func typeFields(t reflect.Type) []structField {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	var fields []structField
+	visited := map[reflect.Type]bool{}
+	// The embedded structs are visited breadth first, so that the fields
+	// of a struct type embedded twice at the same depth conflict.
+	for next := []embedded{{typ: t}}; len(next) > 0; {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			for n := 0; n < e.typ.NumField(); n++ {
+				sf := e.typ.Field(n)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous {
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, options, _ := strings.Cut(tag, ",")
+				if !isValidTag(name) {
+					name = ""
+				}
+				index := append(append([]int(nil), e.index...), n)
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{typ: ft, index: index})
+					continue
+				}
+				field := structField{
+					name:      name,
+					index:     index,
+					tagged:    name != "",
+					omitEmpty: hasTagOption(options, "omitempty"),
+				}
+				if field.name == "" {
+					field.name = sf.Name
+				}
+				if hasTagOption(options, "string") {
+					switch ft.Kind() {
+					case reflect.Bool, reflect.String,
+						reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+						reflect.Float32, reflect.Float64:
+						field.quoted = true
+					}
+				}
+				fields = append(fields, field)
+			}
+		}
+		for _, e := range current {
+			visited[e.typ] = true
+		}
+	}
+
+	// Of the fields with the same name, the shallowest one wins, preferring
+	// the tagged ones. The name is dropped if that is ambiguous.
+	sort.SliceStable(fields, func(a, b int) bool {
+		x, y := fields[a], fields[b]
+		if x.name != y.name {
+			return x.name < y.name
+		}
+		if len(x.index) != len(y.index) {
+			return len(x.index) < len(y.index)
+		}
+		return x.tagged && !y.tagged
+	})
+	dominant := fields[:0]
+	for start := 0; start < len(fields); {
+		end := start + 1
+		for end < len(fields) && fields[end].name == fields[start].name {
+			end++
+		}
+		first := fields[start]
+		if end-start == 1 || len(fields[start+1].index) != len(first.index) || fields[start+1].tagged != first.tagged {
+			dominant = append(dominant, first)
+		}
+		start = end
+	}
+	sort.Slice(dominant, func(a, b int) bool {
+		x, y := dominant[a].index, dominant[b].index
+		for n := 0; n < len(x) && n < len(y); n++ {
+			if x[n] != y[n] {
+				return x[n] < y[n]
+			}
+		}
+		return len(x) < len(y)
+	})
+	return dominant
+}
+
+func isValidTag(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", c) && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTagOption(options, option string) bool {
+	for options != "" {
+		var current string
+		current, options, _ = strings.Cut(options, ",")
+		if current == option {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeInto stores the JSON value v (in the standard Go representation)
+// in the Go value pointed to by target, following the rules of
+// json.Unmarshal, which also describe the errors.
+func decodeInto(v interface{}, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(target)}
+	}
+	d := &decoder{}
+	if err := d.decode(v, rv); err != nil {
+		return err
+	}
+	return d.savedErr
+}
+
+// decoder stores the JSON values in Go values. Like json.Unmarshal, it
+// continues after a type mismatch and reports the first one at the end.
+type decoder struct {
+	savedErr error
+	// structType and fieldStack locate the decoded value for the errors.
+	structType reflect.Type
+	fieldStack []string
+}
+
+func (d *decoder) saveError(err error) {
+	if d.savedErr == nil {
+		d.savedErr = err
+	}
+}
+
+func (d *decoder) typeError(value string, t reflect.Type) {
+	err := &json.UnmarshalTypeError{Value: value, Type: t}
+	if d.structType != nil {
+		err.Struct = d.structType.Name()
+		err.Field = strings.Join(d.fieldStack, ".")
+	}
+	d.saveError(err)
+}
+
+// indirect walks down v, allocating the pointers as needed, until it gets
+// to a non-pointer, or to a value implementing json.Unmarshaler or, unless
+// decodingNull is set, encoding.TextUnmarshaler. With decodingNull it
+// stops at the last pointer, so that it can be set to nil.
+func indirect(v reflect.Value, decodingNull bool) (json.Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	// Start with the address of a named value, so that the methods with
+	// a pointer receiver are found.
+	v0 := v
+	haveAddr := false
+	if v.Kind() != reflect.Ptr && v.Type().Name() != "" && v.CanAddr() {
+		haveAddr = true
+		v = v.Addr()
+	}
+	for {
+		// An interface holding a non-nil pointer is decoded into the
+		// pointed value.
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			e := v.Elem()
+			if e.Kind() == reflect.Ptr && !e.IsNil() && (!decodingNull || e.Elem().Kind() == reflect.Ptr) {
+				haveAddr = false
+				v = e
+				continue
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+		if decodingNull && v.CanSet() {
+			break
+		}
+		// A pointer stored in an interface pointing to itself would
+		// loop forever.
+		if v.Elem().Kind() == reflect.Interface && v.Elem().Elem() == v {
+			v = v.Elem()
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().NumMethod() > 0 && v.CanInterface() {
+			if u, ok := v.Interface().(json.Unmarshaler); ok {
+				return u, nil, reflect.Value{}
+			}
+			if !decodingNull {
+				if u, ok := v.Interface().(encoding.TextUnmarshaler); ok {
+					return nil, u, reflect.Value{}
+				}
+			}
+		}
+		if haveAddr {
+			v = v0
+			haveAddr = false
+		} else {
+			v = v.Elem()
+		}
+	}
+	return nil, nil, v
+}
+
+// unmarshalJSON passes v to a json.Unmarshaler, which needs it as JSON.
+func unmarshalJSON(u json.Unmarshaler, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalJSON(data)
+}
+
+func (d *decoder) decode(v interface{}, rv reflect.Value) error {
+	switch v := v.(type) {
+	case nil:
+		u, _, pv := indirect(rv, true)
+		if u != nil {
+			return u.UnmarshalJSON([]byte("null"))
+		}
+		switch pv.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			pv.Set(reflect.Zero(pv.Type()))
+		}
+		return nil
+
+	case bool:
+		u, ut, pv := indirect(rv, false)
+		if u != nil {
+			return unmarshalJSON(u, v)
+		}
+		if ut != nil {
+			d.typeError("bool", rv.Type())
+			return nil
+		}
+		switch {
+		case pv.Kind() == reflect.Bool:
+			pv.SetBool(v)
+		case pv.Kind() == reflect.Interface && pv.NumMethod() == 0:
+			pv.Set(reflect.ValueOf(v))
+		default:
+			d.typeError("bool", pv.Type())
+		}
+		return nil
+
+	case float64:
+		u, ut, pv := indirect(rv, false)
+		if u != nil {
+			return unmarshalJSON(u, v)
+		}
+		if ut != nil {
+			d.typeError("number", rv.Type())
+			return nil
+		}
+		return d.decodeNumber(v, pv)
+
+	case string:
+		u, ut, pv := indirect(rv, false)
+		if u != nil {
+			return unmarshalJSON(u, v)
+		}
+		if ut != nil {
+			return ut.UnmarshalText([]byte(v))
+		}
+		switch pv.Kind() {
+		case reflect.String:
+			if pv.Type() == jsonNumberType && !isNumberLiteral(v) {
+				return fmt.Errorf("json: invalid number literal, trying to unmarshal %q into Number", v)
+			}
+			pv.SetString(v)
+		case reflect.Slice:
+			if pv.Type().Elem().Kind() != reflect.Uint8 {
+				d.typeError("string", pv.Type())
+				break
+			}
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				d.saveError(err)
+				break
+			}
+			pv.SetBytes(b)
+		case reflect.Interface:
+			if pv.NumMethod() != 0 {
+				d.typeError("string", pv.Type())
+				break
+			}
+			pv.Set(reflect.ValueOf(v))
+		default:
+			d.typeError("string", pv.Type())
+		}
+		return nil
+
+	case []interface{}:
+		u, ut, pv := indirect(rv, false)
+		if u != nil {
+			return unmarshalJSON(u, v)
+		}
+		if ut != nil {
+			d.typeError("array", rv.Type())
+			return nil
+		}
+		return d.decodeArray(v, pv)
+
+	case map[string]interface{}:
+		u, ut, pv := indirect(rv, false)
+		if u != nil {
+			return unmarshalJSON(u, v)
+		}
+		if ut != nil {
+			d.typeError("object", rv.Type())
+			return nil
+		}
+		return d.decodeObject(v, pv)
+	}
+	return fmt.Errorf("unexpected %T in the JSON value", v)
+}
+
+func (d *decoder) decodeNumber(f float64, v reflect.Value) error {
+	literal := strconv.FormatFloat(f, 'g', -1, 64)
+	if data, err := json.Marshal(f); err == nil {
+		literal = string(data)
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			d.typeError("number", v.Type())
+			break
+		}
+		v.Set(reflect.ValueOf(f))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// 2^63 is the first float64 which does not fit.
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= -math.MinInt64 || v.OverflowInt(int64(f)) {
+			d.typeError("number "+literal, v.Type())
+			break
+		}
+		v.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if f != math.Trunc(f) || f < 0 || f >= -2*math.MinInt64 || v.OverflowUint(uint64(f)) {
+			d.typeError("number "+literal, v.Type())
+			break
+		}
+		v.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		if v.OverflowFloat(f) {
+			d.typeError("number "+literal, v.Type())
+			break
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		if v.Type() != jsonNumberType {
+			d.typeError("number", v.Type())
+			break
+		}
+		v.SetString(literal)
+	default:
+		d.typeError("number", v.Type())
+	}
+	return nil
+}
+
+func isNumberLiteral(s string) bool {
+	var n json.Number
+	return json.Unmarshal([]byte(s), &n) == nil && string(n) == s
+}
+
+func (d *decoder) decodeArray(arr []interface{}, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			d.typeError("array", v.Type())
+			return nil
+		}
+		v.Set(reflect.ValueOf(arr))
+		return nil
+	case reflect.Slice:
+		if len(arr) > v.Cap() {
+			grown := reflect.MakeSlice(v.Type(), v.Len(), len(arr))
+			reflect.Copy(grown, v)
+			v.Set(grown)
+		}
+		for n := v.Len(); n < len(arr); n++ {
+			v.SetLen(n + 1)
+			v.Index(n).Set(reflect.Zero(v.Type().Elem()))
+		}
+		v.SetLen(len(arr))
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		}
+	case reflect.Array:
+		for n := len(arr); n < v.Len(); n++ {
+			v.Index(n).Set(reflect.Zero(v.Type().Elem()))
+		}
+	default:
+		d.typeError("array", v.Type())
+		return nil
+	}
+	for n, elem := range arr {
+		if n >= v.Len() {
+			break
+		}
+		if err := d.decode(elem, v.Index(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) decodeObject(obj map[string]interface{}, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			d.typeError("object", v.Type())
+			return nil
+		}
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	case reflect.Map:
+		keyType := v.Type().Key()
+		switch keyType.Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if !reflect.PtrTo(keyType).Implements(textUnmarshalerType) {
+				d.typeError("object", v.Type())
+				return nil
+			}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+	default:
+		d.typeError("object", v.Type())
+		return nil
+	}
+
+	// The names are sorted, so that the reported error does not depend on
+	// the order of the map.
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	structType, fieldStack := d.structType, d.fieldStack
+	defer func() {
+		d.structType, d.fieldStack = structType, fieldStack
+	}()
+	for _, name := range names {
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			d.fieldStack = append(fieldStack[:len(fieldStack):len(fieldStack)], name)
+			if err := d.decode(obj[name], elem); err != nil {
+				return err
+			}
+			key, err := d.mapKey(name, v.Type().Key())
+			if err != nil {
+				return err
+			}
+			if key.IsValid() {
+				v.SetMapIndex(key, elem)
+			}
+			continue
+		}
+
+		field := lookupStructField(structFields(v.Type()), name)
+		if field == nil {
+			continue
+		}
+		fv, err := fieldForDecoding(v, field.index)
+		if err != nil {
+			d.saveError(err)
+			continue
+		}
+		d.structType = v.Type()
+		d.fieldStack = append(fieldStack[:len(fieldStack):len(fieldStack)], field.name)
+		if field.quoted {
+			err = d.decodeQuoted(obj[name], fv)
+		} else {
+			err = d.decode(obj[name], fv)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapKey converts an object field name to a key of a map. It returns an
+// invalid value after saving an error, if the name does not fit.
+func (d *decoder) mapKey(name string, keyType reflect.Type) (reflect.Value, error) {
+	if reflect.PtrTo(keyType).Implements(textUnmarshalerType) {
+		key := reflect.New(keyType)
+		if err := key.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(name)); err != nil {
+			return reflect.Value{}, err
+		}
+		return key.Elem(), nil
+	}
+	key := reflect.New(keyType).Elem()
+	switch keyType.Kind() {
+	case reflect.String:
+		key.SetString(name)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || key.OverflowInt(n) {
+			d.typeError("number "+name, keyType)
+			return reflect.Value{}, nil
+		}
+		key.SetInt(n)
+	default:
+		n, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || key.OverflowUint(n) {
+			d.typeError("number "+name, keyType)
+			return reflect.Value{}, nil
+		}
+		key.SetUint(n)
+	}
+	return key, nil
+}
+
+// lookupStructField returns the field for an object field name, preferring
+// an exact match to a case-insensitive one.
+func lookupStructField(fields []structField, name string) *structField {
+	var folded *structField
+	for n := range fields {
+		if fields[n].name == name {
+			return &fields[n]
+		}
+		if folded == nil && strings.EqualFold(fields[n].name, name) {
+			folded = &fields[n]
+		}
+	}
+	return folded
+}
+
+// fieldForDecoding returns the field of v at index, allocating the nil
+// pointers to the embedded structs on the way.
+func fieldForDecoding(v reflect.Value, index []int) (reflect.Value, error) {
+	for n, x := range index {
+		if n > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("json: cannot set embedded pointer to unexported struct: %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// decodeQuoted decodes a field with the ",string" option, whose value is
+// JSON in a string.
+func (d *decoder) decodeQuoted(v interface{}, fv reflect.Value) error {
+	switch v := v.(type) {
+	case nil:
+		return d.decode(nil, fv)
+	case string:
+		var literal interface{}
+		err := json.Unmarshal([]byte(v), &literal)
+		switch literal.(type) {
+		case nil, bool, float64, string:
+		default:
+			err = errors.New("not a literal")
+		}
+		if err != nil {
+			d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", v, fv.Type()))
+			return nil
+		}
+		return d.decode(literal, fv)
+	}
+	d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal unquoted value into %v", fv.Type()))
+	return nil
+}
+
+// goToValue converts a Go value to a Jsonnet value, following the rules of
+// json.Marshal. The Go values may also contain *Value handles. The created
+// strings and arrays are accounted for as allocations.
+func goToValue(i *interpreter, v interface{}) (value, error) {
+	switch v := v.(type) {
+	case nil, bool, float64, int, int8, int16, int32, int64:
+		return jsonToValue(i, v)
+	}
+	e := &encoder{i: i, seen: make(map[seenKey]struct{})}
+	rv := reflect.ValueOf(v)
+	val, err := e.convert(rv)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.allocate(convertedSize(rv, val)); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// encoder converts Go values to Jsonnet values.
+type encoder struct {
+	i *interpreter
+	// seen holds the pointers, maps and slices which are being converted,
+	// to detect the cycles.
+	seen map[seenKey]struct{}
+}
+
+type seenKey struct {
+	ptr    uintptr
+	typ    reflect.Type
+	length int
+}
+
+func (e *encoder) error(t reflect.Type, format string, args ...interface{}) error {
+	return e.i.Error(fmt.Sprintf("Cannot convert Go value of type %v: %s", t, fmt.Sprintf(format, args...)))
+}
+
+func (e *encoder) convert(v reflect.Value) (value, error) {
+	if !v.IsValid() {
+		return &nullValue, nil
+	}
+	t := v.Type()
+	if t == valueHandleType {
+		handle := v.Interface().(*Value)
+		if handle == nil {
+			return &nullValue, nil
+		}
+		if handle.i != e.i {
+			return nil, e.i.Error("Cannot pass a Value from a different evaluation")
+		}
+		return handle.th.getValue(e.i)
+	}
+
+	// The methods with a pointer receiver are only used for addressable
+	// values, like json.Marshal does.
+	if t.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(t).Implements(jsonMarshalerType) {
+		return e.marshalJSON(v.Addr())
+	}
+	if t.Implements(jsonMarshalerType) {
+		return e.marshalJSON(v)
+	}
+	if t.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(t).Implements(textMarshalerType) {
+		return e.marshalText(v.Addr())
+	}
+	if t.Implements(textMarshalerType) {
+		return e.marshalText(v)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return makeValueBoolean(v.Bool()), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return makeDoubleCheck(e.i, float64(v.Int()))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return makeDoubleCheck(e.i, float64(v.Uint()))
+
+	case reflect.Float32, reflect.Float64:
+		return makeDoubleCheck(e.i, v.Float())
+
+	case reflect.String:
+		if t == jsonNumberType {
+			number := v.String()
+			if number == "" {
+				number = "0"
+			}
+			f, err := strconv.ParseFloat(number, 64)
+			if err != nil || !isNumberLiteral(number) {
+				return nil, e.error(t, "invalid number literal %q", number)
+			}
+			return makeDoubleCheck(e.i, f)
+		}
+		return makeValueString(v.String()), nil
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return &nullValue, nil
+		}
+		return e.convert(v.Elem())
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return &nullValue, nil
+		}
+		key := seenKey{ptr: v.Pointer(), typ: t}
+		if err := e.enter(key, t); err != nil {
+			return nil, err
+		}
+		defer delete(e.seen, key)
+		return e.convert(v.Elem())
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return &nullValue, nil
+		}
+		elemType := t.Elem()
+		if elemType.Kind() == reflect.Uint8 {
+			p := reflect.PtrTo(elemType)
+			if !p.Implements(jsonMarshalerType) && !p.Implements(textMarshalerType) {
+				return makeValueString(base64.StdEncoding.EncodeToString(v.Bytes())), nil
+			}
+		}
+		key := seenKey{ptr: v.Pointer(), typ: t, length: v.Len()}
+		if err := e.enter(key, t); err != nil {
+			return nil, err
+		}
+		defer delete(e.seen, key)
+		return e.convertArray(v)
+
+	case reflect.Array:
+		return e.convertArray(v)
+
+	case reflect.Map:
+		return e.convertMap(v)
+
+	case reflect.Struct:
+		return e.convertStruct(v)
+	}
+	return nil, e.error(t, "unsupported type")
+}
+
+func (e *encoder) enter(key seenKey, t reflect.Type) error {
+	if _, ok := e.seen[key]; ok {
+		return e.error(t, "encountered a cycle")
+	}
+	e.seen[key] = struct{}{}
+	return nil
+}
+
+// marshalJSON converts a json.Marshaler through the JSON it produces.
+func (e *encoder) marshalJSON(v reflect.Value) (value, error) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return &nullValue, nil
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, e.error(v.Type(), "%v", err)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, e.error(v.Type(), "%v", err)
+	}
+	return jsonToValue(e.i, decoded)
+}
+
+func (e *encoder) marshalText(v reflect.Value) (value, error) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return &nullValue, nil
+	}
+	text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return nil, e.error(v.Type(), "%v", err)
+	}
+	return makeValueString(string(text)), nil
+}
+
+// convertedSize returns the size of the string or array converted from v,
+// to be accounted for as an allocation. It is zero for a *Value handle,
+// whose value already exists.
+func convertedSize(v reflect.Value, val value) int {
+	for v.IsValid() && v.Type() != valueHandleType && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.IsValid() && v.Type() == valueHandleType {
+		return 0
+	}
+	return allocatedSize(val, nil)
+}
+
+func (e *encoder) convertArray(v reflect.Value) (value, error) {
+	elems := make([]*cachedThunk, v.Len())
+	size := 0
+	for n := range elems {
+		val, err := e.convert(v.Index(n))
+		if err != nil {
+			return nil, err
+		}
+		elems[n] = readyThunk(val)
+		size += convertedSize(v.Index(n), val)
+	}
+	if err := e.i.allocate(size); err != nil {
+		return nil, err
+	}
+	return makeValueArray(elems), nil
+}
+
+func (e *encoder) convertMap(v reflect.Value) (value, error) {
+	t := v.Type()
+	keyType := t.Key()
+	switch keyType.Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		if !keyType.Implements(textMarshalerType) {
+			return nil, e.error(t, "unsupported type")
+		}
+	}
+	if v.IsNil() {
+		return &nullValue, nil
+	}
+	key := seenKey{ptr: v.Pointer(), typ: t}
+	if err := e.enter(key, t); err != nil {
+		return nil, err
+	}
+	defer delete(e.seen, key)
+
+	fieldMap := make(map[string]value, v.Len())
+	size := 0
+	iter := v.MapRange()
+	for iter.Next() {
+		name, err := e.mapKeyName(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		val, err := e.convert(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		fieldMap[name] = val
+		size += convertedSize(iter.Value(), val)
+	}
+	if err := e.i.allocate(size); err != nil {
+		return nil, err
+	}
+	return buildObject(ast.ObjectFieldInherit, fieldMap), nil
+}
+
+// mapKeyName converts a map key to an object field name. The string keys
+// are used as they are, even if they implement encoding.TextMarshaler.
+func (e *encoder) mapKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		if err != nil {
+			return "", e.error(k.Type(), "%v", err)
+		}
+		return string(text), nil
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	}
+	return strconv.FormatUint(k.Uint(), 10), nil
+}
+
+func (e *encoder) convertStruct(v reflect.Value) (value, error) {
+	fieldMap := map[string]value{}
+	size := 0
+	for _, field := range structFields(v.Type()) {
+		fv, ok := fieldForEncoding(v, field.index)
+		if !ok || field.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		var val value
+		var err error
+		if field.quoted {
+			val, err = e.convertQuoted(fv)
+		} else {
+			val, err = e.convert(fv)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fieldMap[field.name] = val
+		size += convertedSize(fv, val)
+	}
+	if err := e.i.allocate(size); err != nil {
+		return nil, err
+	}
+	return buildObject(ast.ObjectFieldInherit, fieldMap), nil
+}
+
+// fieldForEncoding returns the field of v at index. It returns false if
+// one of the embedded structs on the way is a nil pointer.
+func fieldForEncoding(v reflect.Value, index []int) (reflect.Value, bool) {
+	for n, x := range index {
+		if n > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// convertQuoted converts a field with the ",string" option, whose value is
+// stored as JSON in a string.
+func (e *encoder) convertQuoted(v reflect.Value) (value, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return &nullValue, nil
+		}
+		v = v.Elem()
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, e.error(v.Type(), "%v", err)
+	}
+	return makeValueString(string(data)), nil
+}
+
+// isEmptyValue reports whether a field with the "omitempty" option is
+// omitted.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/go-jsonnet/ast"
+	"github.com/google/go-jsonnet/toolutils"
+)
+
+// Coverage is an EvalHandler which records which parts of the Jsonnet code
+// were evaluated, see VM.Coverage. Since the evaluation is lazy, code which is not needed
+// for the output (e.g. unused fields of library objects) is not covered.
+//
+// It reports line coverage and the coverage of branches, which are the
+// branches of if and the fields of objects.
+//
+// A Coverage must not be used by multiple evaluations at the same time.
+type Coverage struct {
+	// counts holds the number of evaluations of each node.
+	counts map[ast.Node]int
+	// roots holds the AST of each evaluated file.
+	roots map[*ast.Source]ast.Node
+}
+
+// NewCoverage creates an empty coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		counts: make(map[ast.Node]int),
+		roots:  make(map[*ast.Source]ast.Node),
+	}
+}
+
+// BeforeEval records the evaluation of the node.
+func (c *Coverage) BeforeEval(event *EvalEvent) error {
+	node := event.Node
+	c.counts[node]++
+	source := node.Loc().File
+	if source == nil || source.DiagnosticFileName == "<std>" {
+		return nil
+	}
+	if _, ok := c.roots[source]; !ok {
+		// The evaluation of a file starts with its root, so the first node
+		// of a file is the root. VM.AddEvalHandler drops the cached values
+		// of the files, so it is the case also for the files imported
+		// before.
+		c.roots[source] = node
+	}
+	return nil
+}
+
+// AfterEval does nothing.
+func (c *Coverage) AfterEval(event *EvalEvent) error {
+	return nil
+}
+
+// Coverage makes the VM record the evaluated code in the coverage,
+// replacing the coverage set before. A nil coverage stops the recording.
+// The coverage is added as an EvalHandler, see VM.AddEvalHandler.
+func (vm *VM) Coverage(c *Coverage) {
+	for _, handler := range vm.EvalHook.handlers {
+		if old, ok := handler.(*Coverage); ok {
+			vm.RemoveEvalHandler(old)
+		}
+	}
+	if c != nil {
+		vm.AddEvalHandler(c)
+	}
+}
+
+// coverageBranch is one of the branches of an if or an object.
+type coverageBranch struct {
+	line int
+	// block identifies the if or object, and id the branch.
+	block int
+	id    int
+	// taken is the number of evaluations of the branch, or -1 if the if or
+	// object itself was not evaluated.
+	taken int
+}
+
+// fileCoverage is the coverage of a single file.
+type fileCoverage struct {
+	name   string
+	source *ast.Source
+	// lines maps the lines which have code to the number of evaluations.
+	lines    map[int]int
+	branches []coverageBranch
+}
+
+// files computes the coverage of each evaluated file, sorted by name.
+func (c *Coverage) files() []*fileCoverage {
+	var files []*fileCoverage
+	for source, root := range c.roots {
+		file := &fileCoverage{name: string(source.DiagnosticFileName), source: source, lines: make(map[int]int)}
+		c.walk(file, root)
+		sort.SliceStable(file.branches, func(a, b int) bool {
+			return file.branches[a].line < file.branches[b].line
+		})
+		files = append(files, file)
+	}
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].name < files[b].name
+	})
+	return files
+}
+
+func (c *Coverage) walk(file *fileCoverage, node ast.Node) {
+	if node == nil {
+		return
+	}
+	loc := node.Loc()
+	ownCode := loc.IsSet() && loc.File == file.source
+	if ownCode {
+		if count := c.counts[node]; count > file.lines[loc.Begin.Line] {
+			file.lines[loc.Begin.Line] = count
+		} else if _, ok := file.lines[loc.Begin.Line]; !ok {
+			file.lines[loc.Begin.Line] = 0
+		}
+	}
+
+	block := len(file.branches)
+	evaluated := c.counts[node] > 0
+	addBranch := func(line int, branch ast.Node) {
+		taken := -1
+		if evaluated {
+			taken = c.counts[branch]
+		}
+		file.branches = append(file.branches, coverageBranch{line: line, block: block, id: len(file.branches), taken: taken})
+	}
+	switch node := node.(type) {
+	case *ast.Conditional:
+		// Only the if written in the code, not the ones added by desugaring,
+		// e.g. for assertions.
+		if ownCode && node.BranchTrue.Loc().IsSet() {
+			addBranch(loc.Begin.Line, node.BranchTrue)
+			addBranch(loc.Begin.Line, node.BranchFalse)
+		}
+	case *ast.DesugaredObject:
+		if ownCode {
+			for _, field := range node.Fields {
+				if field.LocRange.IsSet() {
+					addBranch(field.LocRange.Begin.Line, field.Body)
+				}
+			}
+		}
+	}
+
+	for _, child := range toolutils.Children(node) {
+		c.walk(file, child)
+	}
+}
+
+func (file *fileCoverage) sortedLines() []int {
+	lines := make([]int, 0, len(file.lines))
+	for line := range file.lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// WriteLCOV writes the coverage in the LCOV tracefile format, with DA
+// records for lines and BRDA records for branches.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for _, file := range c.files() {
+		fmt.Fprintf(out, "SF:%s\n", file.name)
+		branchesHit := 0
+		for _, branch := range file.branches {
+			taken := "-"
+			if branch.taken >= 0 {
+				taken = fmt.Sprint(branch.taken)
+			}
+			if branch.taken > 0 {
+				branchesHit++
+			}
+			fmt.Fprintf(out, "BRDA:%d,%d,%d,%s\n", branch.line, branch.block, branch.id, taken)
+		}
+		fmt.Fprintf(out, "BRF:%d\nBRH:%d\n", len(file.branches), branchesHit)
+		linesHit := 0
+		for _, line := range file.sortedLines() {
+			if file.lines[line] > 0 {
+				linesHit++
+			}
+			fmt.Fprintf(out, "DA:%d,%d\n", line, file.lines[line])
+		}
+		fmt.Fprintf(out, "LF:%d\nLH:%d\n", len(file.lines), linesHit)
+		fmt.Fprintln(out, "end_of_record")
+	}
+	return out.Flush()
+}
+
+// WriteGoCover writes the line coverage in the profile format of
+// `go test -coverprofile`, with a block for each line with code.
+func (c *Coverage) WriteGoCover(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "mode: count")
+	for _, file := range c.files() {
+		for _, line := range file.sortedLines() {
+			endColumn := 1
+			if line <= len(file.source.Lines) {
+				endColumn = len(strings.TrimRight(file.source.Lines[line-1], "\r\n")) + 1
+			}
+			fmt.Fprintf(out, "%s:%d.1,%d.%d 1 %d\n", file.name, line, line, endColumn, file.lines[line])
+		}
+	}
+	return out.Flush()
+}
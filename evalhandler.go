@@ -0,0 +1,107 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"github.com/google/go-jsonnet/ast"
+)
+
+// EvalHandler observes the evaluation of each AST node, e.g. for tracing,
+// profiling or checking policies. See VM.AddEvalHandler.
+//
+// The handlers are called for every node, so they should be fast. They are
+// called recursively if they access the Value of an event, which may need
+// to evaluate more code.
+type EvalHandler interface {
+	// BeforeEval is called before a node is evaluated. If it returns an
+	// error, the node is not evaluated and the evaluation fails with it. The
+	// following handlers are not called then, neither BeforeEval nor
+	// AfterEval.
+	BeforeEval(event *EvalEvent) error
+	// AfterEval is called after a node was evaluated, also if it failed,
+	// if BeforeEval was called for it. If it returns an error, the
+	// evaluation fails with it.
+	AfterEval(event *EvalEvent) error
+}
+
+// EvalEvent describes the evaluation of an AST node.
+type EvalEvent struct {
+	// Node is the node being evaluated. It is desugared, so it may differ
+	// from the code, and it must not be modified.
+	Node ast.Node
+	// Err is the error of the evaluation. It is only set in AfterEval.
+	Err error
+
+	i   *interpreter
+	val value
+}
+
+// StackTrace returns the Jsonnet stack trace at the node, like the one of
+// an error in the node. The innermost frame is the last one.
+func (event *EvalEvent) StackTrace() []TraceFrame {
+	var result []TraceFrame
+	for _, f := range event.i.stack.stack {
+		if f.cleanEnv {
+			result = append(result, traceElementToTraceFrame(f.trace))
+		}
+	}
+	return append(result, traceElementToTraceFrame(traceElement{loc: event.Node.Loc(), context: event.Node.Context()}))
+}
+
+// Value returns a handle to the result of the evaluation. It is nil in
+// BeforeEval and if the evaluation failed. Its contents are evaluated when
+// they are accessed, which may fail and must not happen concurrently with
+// the evaluation of the VM.
+func (event *EvalEvent) Value() *Value {
+	if event.val == nil {
+		return nil
+	}
+	return &Value{i: event.i, th: readyThunk(event.val), nested: true}
+}
+
+// AddEvalHandler makes the VM call the handler for each evaluated node.
+// The handlers are called in the order they were added, after the EvalHook.
+//
+// The cached values of the imported files are dropped, so that the handler
+// sees the evaluation of all the code.
+func (vm *VM) AddEvalHandler(handler EvalHandler) {
+	// Copy the handlers, since they may be shared with clones of the VM.
+	handlers := make([]EvalHandler, 0, len(vm.EvalHook.handlers)+1)
+	handlers = append(handlers, vm.EvalHook.handlers...)
+	vm.EvalHook.handlers = append(handlers, handler)
+	vm.flushValueCache()
+}
+
+// RemoveEvalHandler removes a handler added by AddEvalHandler.
+func (vm *VM) RemoveEvalHandler(handler EvalHandler) {
+	var handlers []EvalHandler
+	for _, h := range vm.EvalHook.handlers {
+		if h != handler {
+			handlers = append(handlers, h)
+		}
+	}
+	vm.EvalHook.handlers = handlers
+}
+
+// handlerError makes an error returned by an EvalHandler a RuntimeError
+// with the stack trace of the node.
+func (event *EvalEvent) handlerError(err error) error {
+	if _, ok := err.(RuntimeError); ok {
+		return err
+	}
+	return makeRuntimeErrorWithCause(err.Error(), event.StackTrace(), err)
+}
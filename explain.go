@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"fmt"
+
+	"github.com/google/go-jsonnet/ast"
+	"github.com/google/go-jsonnet/toolutils"
+)
+
+// FieldLayer is one of the objects combined with + which defines a field.
+type FieldLayer struct {
+	// Location is the location of the field definition, e.g. `a+: 1`. It is
+	// nil if the field does not come from code, e.g. from std.mergePatch.
+	Location *ast.LocationRange
+	// Value is the value this layer contributes, i.e. the body of the field.
+	// For field+: it does not include the value of super.field.
+	Value *Value
+	// Err is set instead of Value if the body cannot be evaluated, e.g. if
+	// it is an error "must be overridden".
+	Err error
+	// Hide is the visibility of the field in this layer (:, :: or :::).
+	Hide ast.ObjectFieldHide
+	// PlusSuper is true if the field is defined with field+:.
+	PlusSuper bool
+	// UsesSuper is true if the field is defined with field+: or its body
+	// refers to super.
+	UsesSuper bool
+}
+
+// Explain returns the layers of an object which define the given field,
+// starting with the one at the bottom of the inheritance chain. Each layer
+// is evaluated separately and the object assertions are not checked.
+func (v *Value) Explain(name string) (layers []FieldLayer, err error) {
+	type definition struct {
+		field    unboundField
+		sb       selfBinding
+		upValues bindingFrame
+	}
+	var definitions []definition
+	err = v.do(func(val value) error {
+		obj, err := v.i.getObject(val)
+		if err != nil {
+			return err
+		}
+		minSuperDepth := 0
+		for {
+			found, field, upValues, locals, foundAt := findField(obj.uncached, minSuperDepth, name)
+			if !found {
+				break
+			}
+			layer := FieldLayer{
+				Location:  field.loc,
+				Hide:      field.hide,
+				PlusSuper: isPlusSuperField(field.field),
+			}
+			layer.UsesSuper = layer.PlusSuper || usesSuper(fieldBody(field.field))
+			layers = append(layers, layer)
+			sb := selfBinding{self: obj, superDepth: foundAt}
+			definitions = append(definitions, definition{
+				field:    withoutPlusSuper(field.field),
+				sb:       sb,
+				upValues: prepareFieldUpvalues(sb, upValues, locals),
+			})
+			minSuperDepth = foundAt + 1
+		}
+		if len(layers) == 0 {
+			return v.i.Error(fmt.Sprintf("Field does not exist: %s", name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Each layer is evaluated on its own, so that the others are evaluated
+	// even if one of them fails.
+	for index, def := range definitions {
+		layers[index].Err = v.do(func(val value) error {
+			layerVal, err := def.field.evaluate(v.i, def.sb, def.upValues, name)
+			if err != nil {
+				return err
+			}
+			layers[index].Value = v.wrap(layerVal)
+			return nil
+		})
+	}
+	for left, right := 0, len(layers)-1; left < right; left, right = left+1, right-1 {
+		layers[left], layers[right] = layers[right], layers[left]
+	}
+	return layers, nil
+}
+
+// withoutPlusSuper returns the field without the addition of super.field
+// of field+:.
+func withoutPlusSuper(field unboundField) unboundField {
+	switch field := field.(type) {
+	case *plusSuperUnboundField:
+		return field.inner
+	case *bindingsUnboundField:
+		return &bindingsUnboundField{inner: withoutPlusSuper(field.inner), bindings: field.bindings}
+	}
+	return field
+}
+
+// fieldBody returns the code of the field or nil if it is not code.
+func fieldBody(field unboundField) ast.Node {
+	switch field := field.(type) {
+	case *codeUnboundField:
+		return field.body
+	case *plusSuperUnboundField:
+		return fieldBody(field.inner)
+	case *bindingsUnboundField:
+		return fieldBody(field.inner)
+	}
+	return nil
+}
+
+// usesSuper checks if the node refers to the super of the object it is in.
+// It does not look into nested objects, which have their own super.
+func usesSuper(node ast.Node) bool {
+	switch node := node.(type) {
+	case nil:
+		return false
+	case *ast.SuperIndex, *ast.InSuper:
+		return true
+	case *ast.DesugaredObject:
+		for _, field := range node.Fields {
+			if usesSuper(field.Name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, child := range toolutils.Children(node) {
+		if usesSuper(child) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImportMap maps import paths to locations, so that they resolve the same
+// way regardless of the library search paths.
+//
+// A key ending with "/" is a prefix, e.g. "k8s/" or "github.com/org/lib/",
+// and maps all imports starting with it to the directory it points to.
+// Other keys map only the exact import path. The longest matching key wins.
+type ImportMap map[string]string
+
+// importMapFile is the format of the files read by LoadImportMap.
+type importMapFile struct {
+	Imports map[string]string `json:"imports"`
+}
+
+// LoadImportMap reads an import map from a JSON file like:
+//
+//	{
+//	  "imports": {
+//	    "k8s/": "vendor/k8s-libsonnet/1.29/",
+//	    "github.com/org/lib/": "../lib/",
+//	    "k.libsonnet": "vendor/k8s-libsonnet/1.29/main.libsonnet"
+//	  }
+//	}
+//
+// Relative locations are relative to the directory of the file.
+func LoadImportMap(filename string) (ImportMap, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file importMapFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("import map %#v: %v", filename, err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	importMap := make(ImportMap, len(file.Imports))
+	for key, location := range file.Imports {
+		if key == "" || location == "" {
+			return nil, fmt.Errorf("import map %#v: empty import path or location", filename)
+		}
+		if strings.HasSuffix(key, "/") != strings.HasSuffix(location, "/") {
+			return nil, fmt.Errorf("import map %#v: %#v and %#v must either both end with \"/\" or neither", filename, key, location)
+		}
+		if !filepath.IsAbs(location) {
+			isDir := strings.HasSuffix(location, "/")
+			location = filepath.Join(dir, location)
+			if isDir {
+				location += "/"
+			}
+		}
+		importMap[key] = location
+	}
+	return importMap, nil
+}
+
+// Resolve returns the location an import path is mapped to, if any.
+func (importMap ImportMap) Resolve(importedPath string) (string, bool) {
+	if location, ok := importMap[importedPath]; ok && !strings.HasSuffix(importedPath, "/") {
+		return location, true
+	}
+	bestKey := ""
+	for key := range importMap {
+		if strings.HasSuffix(key, "/") && strings.HasPrefix(importedPath, key) && len(key) > len(bestKey) {
+			bestKey = key
+		}
+	}
+	if bestKey == "" {
+		return "", false
+	}
+	location := importMap[bestKey]
+	if !strings.HasSuffix(location, "/") {
+		location += "/"
+	}
+	return location + strings.TrimPrefix(importedPath, bestKey), true
+}
+
+// ImportMapImporter wraps another importer, e.g. a FileImporter, and
+// rewrites the import paths found in the Map before passing them on.
+//
+// A mapped import is passed on as if it came from the current directory,
+// so it does not depend on the location of the importing file. Other
+// imports are passed on unchanged.
+type ImportMapImporter struct {
+	Importer Importer
+	Map      ImportMap
+}
+
+// Import imports the mapped path using the wrapped importer.
+func (importer *ImportMapImporter) Import(importedFrom, importedPath string) (contents Contents, foundAt string, err error) {
+	location, mapped := importer.Map.Resolve(importedPath)
+	if !mapped {
+		return importer.Importer.Import(importedFrom, importedPath)
+	}
+	contents, foundAt, err = importer.Importer.Import("", location)
+	if err != nil {
+		return Contents{}, "", fmt.Errorf("import %#v mapped to %#v by the import map: %v", importedPath, location, err)
+	}
+	return contents, foundAt, nil
+}
+
+// Invalidate passes the invalidation to the wrapped importer.
+func (importer *ImportMapImporter) Invalidate(foundAt string) {
+	if cachingImporter, ok := importer.Importer.(CachingImporter); ok {
+		cachingImporter.Invalidate(foundAt)
+	}
+}
+
+// usesFilesystemPaths checks if foundAt returned by the importer is a
+// filesystem path, which can be made absolute and compared.
+func usesFilesystemPaths(importer Importer, foundAt string) bool {
+	switch importer := importer.(type) {
+	case *FileImporter:
+		return true
+	case *ImportMapImporter:
+		return usesFilesystemPaths(importer.Importer, foundAt)
+	case *URLImporter:
+		if _, isURL := parseImportURL("", foundAt); isURL {
+			return false
+		}
+		return usesFilesystemPaths(importer.Importer, foundAt)
+	}
+	return false
+}
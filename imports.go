@@ -17,9 +17,15 @@ limitations under the License.
 package jsonnet
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/google/go-jsonnet/ast"
@@ -57,6 +63,16 @@ type Importer interface {
 	Import(importedFrom, importedPath string) (contents Contents, foundAt string, err error)
 }
 
+// A CachingImporter is an Importer which can be told to forget a file, so
+// that it is read again the next time it is imported. It is used by
+// VM.InvalidateImport. The requirements of Importer apply until the file
+// is invalidated.
+type CachingImporter interface {
+	Importer
+	// Invalidate drops the cached contents of the file found at foundAt.
+	Invalidate(foundAt string)
+}
+
 // Contents is a representation of imported data. It is a simple
 // byte wrapper, which makes it easier to enforce the caching policy.
 type Contents struct {
@@ -96,53 +112,259 @@ func MakeContentsRaw(bytes []byte) Contents {
 // is an additional layer of optimization that caches values
 // (i.e. the result of executing the file content).
 // It also verifies that the content pointer is the same for two foundAt values.
+//
+// The imported data and ASTs are kept in a sharedImportCache, which may be
+// used by multiple VMs at once (see VM.Clone). The values are specific
+// to a VM, because they depend on external variables and native functions.
 type importCache struct {
+	shared    *sharedImportCache
+	codeCache map[string]codeCacheEntry
+}
+
+// codeCacheEntry is the value of an imported file. It is only valid as
+// long as the version of the file in sharedImportCache is the same.
+type codeCacheEntry struct {
+	pv      potentialValue
+	version int
+}
+
+// sharedImportCache is the part of importCache which does not depend on
+// the evaluation parameters. It is safe for concurrent use. The cached
+// entries are read under a shared lock and the lock is never held while
+// importing or parsing a file. The calls of the importer are serialized,
+// so it does not need to be safe for concurrent use itself.
+type sharedImportCache struct {
+	mu sync.RWMutex
+	// imports holds the results of the importer. They do not change for
+	// given (importedFrom, importedPath), unless the file is invalidated.
+	imports             map[importKey]*importEntry
 	foundAtVerification map[string]Contents
-	astCache            map[string]ast.Node
-	codeCache           map[string]potentialValue
-	importer            Importer
+	astCache            map[string]*astCacheEntry
+	// importedBy maps foundAt to the files which imported it.
+	importedBy map[string]map[string]struct{}
+	// versions are incremented when a file or any of its (transitive)
+	// imports is invalidated. Missing entries mean version 0.
+	versions map[string]int
+	importer Importer
+	// importerMu serializes the calls of the importer. It is only taken
+	// when a path is imported for the first time.
+	importerMu sync.Mutex
+	// lock records or verifies the hashes of the imported files, if set.
+	lock *importLock
+	// locked holds the files which were checked by lock. The entrypoint is
+	// only checked when it is imported by another file.
+	locked map[string]struct{}
+}
+
+type importKey struct {
+	importedFrom string
+	importedPath string
+	// entrypoint is set for the file which is evaluated, see
+	// importCache.importEntrypoint. It is not checked by the lock.
+	entrypoint bool
+}
+
+// importEntry is the result of importing an importKey. It is filled in
+// once, by the first import of the key.
+type importEntry struct {
+	once     sync.Once
+	contents Contents
+	foundAt  string
+	err      error
+}
+
+// astCacheEntry is the AST of the contents of a file. It is parsed once,
+// by the first import of the file.
+type astCacheEntry struct {
+	once     sync.Once
+	contents Contents
+	node     ast.Node
+	err      error
 }
 
 // makeImportCache creates an importCache using an Importer.
-func makeImportCache(importer Importer) *importCache {
+func makeImportCache(importer Importer, lock *importLock) *importCache {
+	return &importCache{
+		shared: &sharedImportCache{
+			importer:            importer,
+			lock:                lock,
+			imports:             make(map[importKey]*importEntry),
+			foundAtVerification: make(map[string]Contents),
+			locked:              make(map[string]struct{}),
+			astCache:            make(map[string]*astCacheEntry),
+			importedBy:          make(map[string]map[string]struct{}),
+			versions:            make(map[string]int),
+		},
+		codeCache: make(map[string]codeCacheEntry),
+	}
+}
+
+// clone creates an importCache which shares the imported data and ASTs
+// with cache, but has its own values.
+func (cache *importCache) clone() *importCache {
 	return &importCache{
-		importer:            importer,
-		foundAtVerification: make(map[string]Contents),
-		astCache:            make(map[string]ast.Node),
-		codeCache:           make(map[string]potentialValue),
+		shared:    cache.shared,
+		codeCache: make(map[string]codeCacheEntry),
 	}
 }
 
 func (cache *importCache) flushValueCache() {
-	cache.codeCache = make(map[string]potentialValue)
+	cache.codeCache = make(map[string]codeCacheEntry)
+}
+
+func (cache *importCache) importedFiles() []string {
+	shared := cache.shared
+	shared.mu.RLock()
+	defer shared.mu.RUnlock()
+	files := make([]string, 0, len(shared.foundAtVerification))
+	for foundAt := range shared.foundAtVerification {
+		files = append(files, foundAt)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// invalidate drops the cached data and AST of foundAt and invalidates the
+// values of foundAt and all files which import it, directly or transitively.
+func (cache *importCache) invalidate(foundAt string) {
+	shared := cache.shared
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	delete(shared.foundAtVerification, foundAt)
+	delete(shared.locked, foundAt)
+	delete(shared.astCache, foundAt)
+	for key, entry := range shared.imports {
+		if entry.foundAt == foundAt {
+			delete(shared.imports, key)
+		}
+	}
+	if importer, ok := shared.importer.(CachingImporter); ok {
+		shared.importerMu.Lock()
+		importer.Invalidate(foundAt)
+		shared.importerMu.Unlock()
+	}
+	visited := map[string]bool{foundAt: true}
+	queue := []string{foundAt}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		shared.versions[current]++
+		for importedFrom := range shared.importedBy[current] {
+			if !visited[importedFrom] {
+				visited[importedFrom] = true
+				queue = append(queue, importedFrom)
+			}
+		}
+	}
 }
 
 func (cache *importCache) importData(importedFrom, importedPath string) (contents Contents, foundAt string, err error) {
-	contents, foundAt, err = cache.importer.Import(importedFrom, importedPath)
+	return cache.shared.importData(importKey{importedFrom: importedFrom, importedPath: importedPath})
+}
+
+func (shared *sharedImportCache) importData(key importKey) (contents Contents, foundAt string, err error) {
+	shared.mu.RLock()
+	entry, ok := shared.imports[key]
+	shared.mu.RUnlock()
+	if !ok {
+		shared.mu.Lock()
+		if entry, ok = shared.imports[key]; !ok {
+			entry = &importEntry{}
+			shared.imports[key] = entry
+		}
+		shared.mu.Unlock()
+	}
+	entry.once.Do(func() {
+		shared.load(key, entry)
+	})
+	return entry.contents, entry.foundAt, entry.err
+}
+
+// load fills in a new entry using the importer.
+func (shared *sharedImportCache) load(key importKey, entry *importEntry) {
+	shared.importerMu.Lock()
+	contents, foundAt, err := shared.importer.Import(key.importedFrom, key.importedPath)
+	shared.importerMu.Unlock()
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	if err == nil {
+		err = shared.record(key, contents, foundAt)
+	}
 	if err != nil {
-		return Contents{}, "", err
+		// Errors are not cached, the next import tries again.
+		if shared.imports[key] == entry {
+			delete(shared.imports, key)
+		}
+		entry.err = err
+		return
 	}
-	if cached, importedBefore := cache.foundAtVerification[foundAt]; importedBefore {
+	entry.contents, entry.foundAt = contents, foundAt
+}
+
+// record verifies and records newly imported contents. It is called with
+// mu held.
+func (shared *sharedImportCache) record(key importKey, contents Contents, foundAt string) error {
+	if cached, importedBefore := shared.foundAtVerification[foundAt]; importedBefore {
 		if cached != contents {
 			panic(fmt.Sprintf("importer problem: a different instance of Contents returned when importing %#v again", foundAt))
 		}
-	} else {
-		cache.foundAtVerification[foundAt] = contents
 	}
-	return
+	if !key.entrypoint && shared.lock != nil {
+		if _, checked := shared.locked[foundAt]; !checked {
+			if err := shared.lock.check(shared.importer, key.importedPath, foundAt, contents); err != nil {
+				return err
+			}
+			shared.locked[foundAt] = struct{}{}
+		}
+	}
+	shared.foundAtVerification[foundAt] = contents
+	if key.importedFrom != "" {
+		if shared.importedBy[foundAt] == nil {
+			shared.importedBy[foundAt] = make(map[string]struct{})
+		}
+		shared.importedBy[foundAt][key.importedFrom] = struct{}{}
+	}
+	return nil
 }
 
 func (cache *importCache) importAST(importedFrom, importedPath string) (ast.Node, string, error) {
-	contents, foundAt, err := cache.importData(importedFrom, importedPath)
+	node, foundAt, _, err := cache.importVersionedAST(importKey{importedFrom: importedFrom, importedPath: importedPath})
+	return node, foundAt, err
+}
+
+// importEntrypoint imports the file which is evaluated. Unlike the files
+// it imports, it is not checked by the lock, so that it can be edited
+// without updating the lockfile.
+func (cache *importCache) importEntrypoint(importedFrom, importedPath string) (ast.Node, string, error) {
+	node, foundAt, _, err := cache.importVersionedAST(importKey{importedFrom: importedFrom, importedPath: importedPath, entrypoint: true})
+	return node, foundAt, err
+}
+
+// importVersionedAST is like importAST, but it also returns the current
+// version of the file.
+func (cache *importCache) importVersionedAST(key importKey) (ast.Node, string, int, error) {
+	shared := cache.shared
+	contents, foundAt, err := shared.importData(key)
 	if err != nil {
-		return nil, "", err
+		return nil, "", 0, err
 	}
-	if cachedNode, isCached := cache.astCache[foundAt]; isCached {
-		return cachedNode, foundAt, nil
+	shared.mu.RLock()
+	version := shared.versions[foundAt]
+	entry, ok := shared.astCache[foundAt]
+	shared.mu.RUnlock()
+	if !ok || entry.contents != contents {
+		shared.mu.Lock()
+		if entry, ok = shared.astCache[foundAt]; !ok || entry.contents != contents {
+			entry = &astCacheEntry{contents: contents}
+			shared.astCache[foundAt] = entry
+		}
+		shared.mu.Unlock()
 	}
-	node, err := program.SnippetToAST(ast.DiagnosticFileName(foundAt), foundAt, contents.String())
-	cache.astCache[foundAt] = node
-	return node, foundAt, err
+	entry.once.Do(func() {
+		entry.node, entry.err = program.SnippetToAST(ast.DiagnosticFileName(foundAt), foundAt, contents.String())
+	})
+	return entry.node, foundAt, version, entry.err
 }
 
 // ImportString imports a string, caches it and then returns it.
@@ -151,7 +373,11 @@ func (cache *importCache) importString(importedFrom, importedPath string, i *int
 	if err != nil {
 		return nil, i.Error(err.Error())
 	}
-	return makeValueString(data.String()), nil
+	str := makeValueString(data.String())
+	if err := i.allocate(str.length()); err != nil {
+		return nil, err
+	}
+	return str, nil
 }
 
 // ImportString imports an array of bytes, caches it and then returns it.
@@ -161,6 +387,9 @@ func (cache *importCache) importBinary(importedFrom, importedPath string, i *int
 		return nil, i.Error(err.Error())
 	}
 	bytes := data.Data()
+	if err := i.allocate(len(bytes)); err != nil {
+		return nil, err
+	}
 	elements := make([]*cachedThunk, len(bytes))
 	for i := range bytes {
 		elements[i] = readyThunk(intToValue(int(bytes[i])))
@@ -177,6 +406,14 @@ func nodeToPV(i *interpreter, filename string, node ast.Node) *cachedThunk {
 	}
 }
 
+func goValueToPV(i *interpreter, v interface{}) *cachedThunk {
+	val, err := goToValue(i, v)
+	if err != nil {
+		return &cachedThunk{err: err}
+	}
+	return readyThunk(val)
+}
+
 func codeToPV(i *interpreter, filename string, code string) *cachedThunk {
 	node, err := program.SnippetToAST(ast.DiagnosticFileName(filename), "", code)
 	if err != nil {
@@ -192,22 +429,23 @@ func codeToPV(i *interpreter, filename string, code string) *cachedThunk {
 
 // ImportCode imports code from a path.
 func (cache *importCache) importCode(importedFrom, importedPath string, i *interpreter) (value, error) {
-	node, foundAt, err := cache.importAST(importedFrom, importedPath)
+	node, foundAt, version, err := cache.importVersionedAST(importKey{importedFrom: importedFrom, importedPath: importedPath})
 	if err != nil {
 		return nil, i.Error(err.Error())
 	}
 	var pv potentialValue
-	if cachedPV, isCached := cache.codeCache[foundAt]; !isCached {
-		// File hasn't been parsed and analyzed before, update the cache record.
+	if cached, isCached := cache.codeCache[foundAt]; !isCached || cached.version != version {
+		// File hasn't been parsed and analyzed before (or it was invalidated),
+		// update the cache record.
 		env := makeInitialEnv(foundAt, i.baseStd)
 		pv = &cachedThunk{
 			env:     &env,
 			body:    node,
 			content: nil,
 		}
-		cache.codeCache[foundAt] = pv
+		cache.codeCache[foundAt] = codeCacheEntry{pv: pv, version: version}
 	} else {
-		pv = cachedPV
+		pv = cached.pv
 	}
 	return i.evaluatePV(pv)
 }
@@ -216,17 +454,40 @@ func (cache *importCache) importCode(importedFrom, importedPath string, i *inter
 // -------------------------------------
 
 // FileImporter imports data from the filesystem.
+//
+// Library archives (.zip, .tar, .tar.gz and .tgz files) are treated like
+// directories, so they can be used as JPaths and the files inside can
+// import each other with relative paths.
+//
+// If AllowedRoots is not empty, only files inside these directories can be
+// imported, e.g. when evaluating untrusted code. The paths are made absolute
+// and symlinks are resolved before checking them, so neither "..", absolute
+// paths nor symlinks can be used to escape the roots. AllowedRoots must not
+// be changed after the first import.
 type FileImporter struct {
-	fsCache map[string]*fsCacheEntry
-	JPaths  []string
+	fsCache      map[string]*fsCacheEntry
+	archives     map[string]archiveContents
+	JPaths       []string
+	AllowedRoots []string
+	// canonicalRoots are the AllowedRoots with symlinks resolved.
+	canonicalRoots []string
 }
 
 type fsCacheEntry struct {
 	contents Contents
-	exists   bool
+	// Description of the archive entry, if the path points inside an archive.
+	archiveEntry string
+	exists       bool
 }
 
-func (importer *FileImporter) tryPath(dir, importedPath string) (found bool, contents Contents, foundHere string, err error) {
+// importAttempts describes the paths which were tried by FileImporter
+// without success, to explain why an import could not be found.
+type importAttempts struct {
+	archiveEntries []string
+	blocked        []string
+}
+
+func (importer *FileImporter) tryPath(dir, importedPath string, attempts *importAttempts) (found bool, contents Contents, foundHere string, err error) {
 	if importer.fsCache == nil {
 		importer.fsCache = make(map[string]*fsCacheEntry)
 	}
@@ -236,9 +497,39 @@ func (importer *FileImporter) tryPath(dir, importedPath string) (found bool, con
 	} else {
 		absPath = filepath.Join(dir, importedPath)
 	}
+	if len(importer.AllowedRoots) > 0 {
+		canonicalPath, exists, allowed, err := importer.confine(absPath)
+		if err != nil {
+			return false, Contents{}, "", err
+		}
+		if !exists {
+			return false, Contents{}, "", nil
+		}
+		if !allowed {
+			blocked := fmt.Sprintf("%#v", absPath)
+			if canonicalPath != filepath.Clean(absPath) {
+				blocked += fmt.Sprintf(" (resolved to %#v)", canonicalPath)
+			}
+			attempts.blocked = append(attempts.blocked, blocked)
+			return false, Contents{}, "", nil
+		}
+		absPath = canonicalPath
+	}
 	var entry *fsCacheEntry
 	if cacheEntry, isCached := importer.fsCache[absPath]; isCached {
 		entry = cacheEntry
+	} else if archivePath, entryName, inArchive := splitArchivePath(absPath); inArchive {
+		archive, err := importer.readArchive(archivePath)
+		if err != nil {
+			return false, Contents{}, "", err
+		}
+		contents, exists := archive[entryName]
+		entry = &fsCacheEntry{
+			exists:       exists,
+			contents:     contents,
+			archiveEntry: fmt.Sprintf("entry %#v in archive %#v", entryName, archivePath),
+		}
+		importer.fsCache[absPath] = entry
 	} else {
 		contentBytes, err := os.ReadFile(absPath)
 		if err != nil {
@@ -257,9 +548,70 @@ func (importer *FileImporter) tryPath(dir, importedPath string) (found bool, con
 		}
 		importer.fsCache[absPath] = entry
 	}
+	if !entry.exists && entry.archiveEntry != "" {
+		attempts.archiveEntries = append(attempts.archiveEntries, entry.archiveEntry)
+	}
 	return entry.exists, entry.contents, absPath, nil
 }
 
+// confine resolves the path to its canonical form and checks if it is
+// inside the AllowedRoots.
+func (importer *FileImporter) confine(p string) (canonicalPath string, exists bool, allowed bool, err error) {
+	if importer.canonicalRoots == nil {
+		for _, root := range importer.AllowedRoots {
+			canonicalRoot, err := getAbsPath(root)
+			if err != nil {
+				return "", false, false, fmt.Errorf("invalid allowed root %#v: %v", root, err)
+			}
+			importer.canonicalRoots = append(importer.canonicalRoots, canonicalRoot)
+		}
+	}
+	canonicalPath, err = getAbsPath(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, false, nil
+		}
+		return "", false, false, err
+	}
+	for _, root := range importer.canonicalRoots {
+		relPath, err := filepath.Rel(root, canonicalPath)
+		if err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return canonicalPath, true, true, nil
+		}
+	}
+	return canonicalPath, true, false, nil
+}
+
+func (importer *FileImporter) readArchive(archivePath string) (archiveContents, error) {
+	if importer.archives == nil {
+		importer.archives = make(map[string]archiveContents)
+	}
+	if archive, isCached := importer.archives[archivePath]; isCached {
+		return archive, nil
+	}
+	archive, err := readArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	importer.archives[archivePath] = archive
+	return archive, nil
+}
+
+// Invalidate drops the cached contents of the file. If it is inside
+// an archive, the whole archive is read again.
+func (importer *FileImporter) Invalidate(foundAt string) {
+	delete(importer.fsCache, foundAt)
+	if archivePath, _, inArchive := splitArchivePath(foundAt); inArchive {
+		delete(importer.archives, archivePath)
+		prefix := archivePath + string(filepath.Separator)
+		for p := range importer.fsCache {
+			if strings.HasPrefix(p, prefix) {
+				delete(importer.fsCache, p)
+			}
+		}
+	}
+}
+
 // Import imports file from the filesystem.
 func (importer *FileImporter) Import(importedFrom, importedPath string) (contents Contents, foundAt string, err error) {
 	// TODO(sbarzowski) Make sure that dir is absolute and resolving of ""
@@ -268,6 +620,94 @@ func (importer *FileImporter) Import(importedFrom, importedPath string) (content
 	// We need to relativize the paths in the error formatter, so that the stack traces
 	// don't have ugly absolute paths (less readable and messy with golden tests).
 	dir, _ := filepath.Split(importedFrom)
+	var attempts importAttempts
+	found, content, foundHere, err := importer.tryPath(dir, importedPath, &attempts)
+	if err != nil {
+		return Contents{}, "", err
+	}
+
+	for i := len(importer.JPaths) - 1; !found && i >= 0; i-- {
+		found, content, foundHere, err = importer.tryPath(importer.JPaths[i], importedPath, &attempts)
+		if err != nil {
+			return Contents{}, "", err
+		}
+	}
+
+	if !found {
+		if len(attempts.blocked) > 0 {
+			return Contents{}, "", fmt.Errorf("couldn't open import %#v: access to %s is blocked, only files inside the allowed roots can be imported", importedPath, strings.Join(attempts.blocked, ", "))
+		}
+		if len(attempts.archiveEntries) > 0 {
+			return Contents{}, "", fmt.Errorf("couldn't open import %#v: no match locally or in the Jsonnet library paths (tried %s)", importedPath, strings.Join(attempts.archiveEntries, ", "))
+		}
+		return Contents{}, "", fmt.Errorf("couldn't open import %#v: no match locally or in the Jsonnet library paths", importedPath)
+	}
+	return content, foundHere, nil
+}
+
+// FSImporter imports data from an fs.FS, e.g. embed.FS, zip.Reader
+// or fstest.MapFS.
+//
+// The paths are slash-separated, like in the io/fs package. Relative imports
+// are resolved relative to the importing file first and then relative to
+// the JPaths (later ones take precedence, like in FileImporter). Absolute
+// imports are relative to the root of FS. The returned foundAt is the path
+// of the file within FS.
+type FSImporter struct {
+	FS      fs.FS
+	fsCache map[string]*fsCacheEntry
+	JPaths  []string
+}
+
+func (importer *FSImporter) tryPath(dir, importedPath string) (found bool, contents Contents, foundHere string, err error) {
+	if importer.fsCache == nil {
+		importer.fsCache = make(map[string]*fsCacheEntry)
+	}
+	var fullPath string
+	if path.IsAbs(importedPath) {
+		fullPath = path.Clean(strings.TrimLeft(importedPath, "/"))
+	} else {
+		fullPath = path.Join(dir, importedPath)
+	}
+	if !fs.ValidPath(fullPath) {
+		// E.g. a path going outside of the root with "..".
+		return false, Contents{}, "", nil
+	}
+	var entry *fsCacheEntry
+	if cacheEntry, isCached := importer.fsCache[fullPath]; isCached {
+		entry = cacheEntry
+	} else {
+		contentBytes, err := fs.ReadFile(importer.FS, fullPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				entry = &fsCacheEntry{
+					exists: false,
+				}
+			} else {
+				return false, Contents{}, "", err
+			}
+		} else {
+			entry = &fsCacheEntry{
+				exists:   true,
+				contents: MakeContentsRaw(contentBytes),
+			}
+		}
+		importer.fsCache[fullPath] = entry
+	}
+	return entry.exists, entry.contents, fullPath, nil
+}
+
+// Invalidate drops the cached contents of the file.
+func (importer *FSImporter) Invalidate(foundAt string) {
+	delete(importer.fsCache, foundAt)
+}
+
+// Import imports a file from the FS.
+func (importer *FSImporter) Import(importedFrom, importedPath string) (contents Contents, foundAt string, err error) {
+	dir := "."
+	if importedFrom != "" {
+		dir = path.Dir(importedFrom)
+	}
 	found, content, foundHere, err := importer.tryPath(dir, importedPath)
 	if err != nil {
 		return Contents{}, "", err
@@ -18,6 +18,7 @@ package jsonnet
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"math"
@@ -256,6 +257,8 @@ func makeCallStack(limit int) callStack {
 type EvalHook struct {
 	pre  func(i *interpreter, n ast.Node)
 	post func(i *interpreter, n ast.Node, v value, err error)
+	// handlers are added by VM.AddEvalHandler.
+	handlers []EvalHandler
 }
 
 // Keeps current execution context and evaluates things
@@ -267,7 +270,7 @@ type interpreter struct {
 	extVars map[string]*cachedThunk
 
 	// Native functions
-	nativeFuncs map[string]*NativeFunction
+	nativeFuncs map[string]evalCallable
 
 	// A part of std object common to all files
 	baseStd *valueObject
@@ -281,6 +284,37 @@ type interpreter struct {
 	stack callStack
 
 	evalHook EvalHook
+
+	// The evaluation is aborted when this context is done.
+	ctx context.Context
+
+	// Number of steps left until the context is checked again.
+	stepsUntilContextCheck int
+
+	// Resource limits of this evaluation and the usage so far.
+	limits    evalLimits
+	steps     int
+	allocated int
+
+	// Collects the source map during manifestation, if requested. It is
+	// nil while evaluating code, so that e.g. std.manifestJson does not
+	// record anything.
+	sourceMap *sourceMapBuilder
+
+	// The size of the output manifested so far, which is tracked to enforce
+	// the output size limit. Like sourceMap, it is nil while evaluating code.
+	outputSize *int
+}
+
+// evalLimits are the resource limits of a single evaluation.
+// Zero means that there is no limit.
+type evalLimits struct {
+	// Number of evaluated AST nodes.
+	maxSteps int
+	// Total number of array elements and string characters created.
+	maxAllocations int
+	// Size of the manifested output in bytes.
+	maxOutputSize int
 }
 
 // Map union, b takes precedence when keys collide.
@@ -307,10 +341,107 @@ func (i *interpreter) newCall(env environment, trimmable bool) error {
 	return nil
 }
 
+// contextCheckInterval is the number of evaluation steps between checks
+// of the context. Checking it on every step would slow down the evaluation
+// noticeably.
+const contextCheckInterval = 1000
+
+// checkInterrupted returns an error if the context of the evaluation is done.
+// It is cheap enough to be called on every evaluation step.
+func (i *interpreter) checkInterrupted() error {
+	if i.stepsUntilContextCheck > 0 {
+		i.stepsUntilContextCheck--
+		return nil
+	}
+	i.stepsUntilContextCheck = contextCheckInterval
+	if err := i.ctx.Err(); err != nil {
+		return makeRuntimeErrorWithCause(
+			fmt.Sprintf("evaluation aborted: %v", err), i.getCurrentStackTrace(), err)
+	}
+	return nil
+}
+
+// step is called for every evaluated AST node. It enforces the step limit
+// and checks whether the evaluation was interrupted.
+func (i *interpreter) step() error {
+	if i.limits.maxSteps > 0 {
+		i.steps++
+		if i.steps > i.limits.maxSteps {
+			return makeRuntimeErrorWithCause(
+				fmt.Sprintf("max evaluation steps exceeded (%d).", i.limits.maxSteps), i.getCurrentStackTrace(), ErrMaxStepsExceeded)
+		}
+	}
+	return i.checkInterrupted()
+}
+
+// allocate accounts for n array elements or string characters created
+// during the evaluation and enforces the allocation limit.
+func (i *interpreter) allocate(n int) error {
+	if err := i.checkAllocation(n); err != nil {
+		return err
+	}
+	i.allocated += n
+	return nil
+}
+
+// checkAllocation returns an error if allocating n more array elements or
+// string characters would exceed the allocation limit. It is used before
+// creating large values, which are accounted for afterwards.
+func (i *interpreter) checkAllocation(n int) error {
+	if i.limits.maxAllocations > 0 && i.allocated+n > i.limits.maxAllocations {
+		return makeRuntimeErrorWithCause(
+			fmt.Sprintf("max allocations exceeded (%d).", i.limits.maxAllocations), i.getCurrentStackTrace(), ErrMaxAllocationsExceeded)
+	}
+	return nil
+}
+
+// addOutputSize accounts for n bytes of the output being manifested and
+// enforces the output size limit.
+func (i *interpreter) addOutputSize(n int) error {
+	if i.outputSize == nil {
+		return nil
+	}
+	*i.outputSize += n
+	return i.checkOutputSize(*i.outputSize)
+}
+
+// checkOutputSize enforces the limit on the size of the manifested output.
+func (i *interpreter) checkOutputSize(size int) error {
+	if i.limits.maxOutputSize > 0 && size > i.limits.maxOutputSize {
+		return makeRuntimeErrorWithCause(
+			fmt.Sprintf("max output size exceeded (%d bytes).", i.limits.maxOutputSize), i.getCurrentStackTrace(), ErrMaxOutputSizeExceeded)
+	}
+	return nil
+}
+
 func (i *interpreter) evaluate(a ast.Node, tc tailCallStatus) (value, error) {
 	i.evalHook.pre(i, a)
-	v, err := i.rawevaluate(a, tc)
+	var v value
+	var err error
+	// handlers are the handlers whose BeforeEval was called.
+	handlers := i.evalHook.handlers
+	if len(handlers) > 0 {
+		event := &EvalEvent{Node: a, i: i}
+		for index, handler := range handlers {
+			if handlerErr := handler.BeforeEval(event); handlerErr != nil {
+				err = event.handlerError(handlerErr)
+				handlers = handlers[:index+1]
+				break
+			}
+		}
+	}
+	if err == nil {
+		v, err = i.rawevaluate(a, tc)
+	}
 	i.evalHook.post(i, a, v, err)
+	if len(handlers) > 0 {
+		event := &EvalEvent{Node: a, Err: err, i: i, val: v}
+		for _, handler := range handlers {
+			if handlerErr := handler.AfterEval(event); handlerErr != nil && err == nil {
+				v, err = nil, event.handlerError(handlerErr)
+			}
+		}
+	}
 	return v, err
 }
 
@@ -324,8 +455,15 @@ func (i *interpreter) rawevaluate(a ast.Node, tc tailCallStatus) (value, error)
 	i.stack.setCurrentTrace(trace)
 	defer func() { i.stack.clearCurrentTrace(); i.stack.setCurrentTrace(oldTrace) }()
 
+	if err := i.step(); err != nil {
+		return nil, err
+	}
+
 	switch node := a.(type) {
 	case *ast.Array:
+		if err := i.allocate(len(node.Elements)); err != nil {
+			return nil, err
+		}
 		sb := i.stack.getSelfBinding()
 		var elements []*cachedThunk
 		for _, el := range node.Elements {
@@ -384,7 +522,11 @@ func (i *interpreter) rawevaluate(a ast.Node, tc tailCallStatus) (value, error)
 			}
 			// TODO(dcunnin): The double dereference here is probably not necessary.
 			builtin := bopBuiltins[node.Op]
-			return builtin.function(i, left, right)
+			result, err := builtin.function(i, left, right)
+			if err != nil {
+				return nil, err
+			}
+			return allocatedResult(i, result, left, right)
 		}
 
 	case *ast.Unary:
@@ -418,7 +560,7 @@ func (i *interpreter) rawevaluate(a ast.Node, tc tailCallStatus) (value, error)
 	case *ast.DesugaredObject:
 		// Evaluate all the field names.  Check for null, dups, etc.
 		fields := make(simpleObjectFieldMap, len(node.Fields))
-		for _, field := range node.Fields {
+		for index, field := range node.Fields {
 			fieldNameValue, err := i.evaluate(field.Name, nonTailCall)
 			if err != nil {
 				return nil, err
@@ -441,7 +583,7 @@ func (i *interpreter) rawevaluate(a ast.Node, tc tailCallStatus) (value, error)
 			if field.PlusSuper {
 				f = &plusSuperUnboundField{f}
 			}
-			fields[fieldName] = simpleObjectField{f, field.Hide}
+			fields[fieldName] = simpleObjectField{f, field.Hide, &node.Fields[index].LocRange}
 		}
 		var asserts []unboundField
 		for _, assert := range node.Asserts {
@@ -536,7 +678,11 @@ func (i *interpreter) rawevaluate(a ast.Node, tc tailCallStatus) (value, error)
 		return makeValueNumber(num), nil
 
 	case *ast.LiteralString:
-		return makeValueString(node.Value), nil
+		str := makeValueString(node.Value)
+		if err := i.allocate(str.length()); err != nil {
+			return nil, err
+		}
+		return str, nil
 
 	case *ast.Local:
 		vars := make(bindingFrame, len(node.Binds))
@@ -689,6 +835,10 @@ func (i *interpreter) manifestJSON(v value) (interface{}, error) {
 		panic("manifesting JSON with empty traceElement")
 	}
 
+	if err := i.checkInterrupted(); err != nil {
+		return nil, err
+	}
+
 	// Fresh frame for better stack traces
 	err := i.newCall(environment{}, false)
 	if err != nil {
@@ -700,33 +850,56 @@ func (i *interpreter) manifestJSON(v value) (interface{}, error) {
 	switch v := v.(type) {
 
 	case *valueBoolean:
+		if err := i.addOutputSize(len(strconv.FormatBool(v.value))); err != nil {
+			return nil, err
+		}
 		return v.value, nil
 
 	case *valueFunction:
 		return nil, makeRuntimeError("couldn't manifest function as JSON", i.getCurrentStackTrace())
 
 	case *valueNumber:
+		if err := i.addOutputSize(len(unparseNumber(v.value))); err != nil {
+			return nil, err
+		}
 		return v.value, nil
 
 	case valueString:
-		return v.getGoString(), nil
+		str := v.getGoString()
+		if err := i.addOutputSize(len(str)); err != nil {
+			return nil, err
+		}
+		return str, nil
 
 	case *valueNull:
+		if err := i.addOutputSize(len("null")); err != nil {
+			return nil, err
+		}
 		return nil, nil
 
 	case *valueArray:
+		if len(v.elements) == 0 {
+			if err := i.addOutputSize(len("[]")); err != nil {
+				return nil, err
+			}
+		}
 		result := make([]interface{}, 0, len(v.elements))
 		for index, th := range v.elements {
 			msg := ast.MakeLocationRangeMessage(fmt.Sprintf("Array element %d", index))
 			i.stack.setCurrentTrace(traceElement{
 				loc: &msg,
 			})
+			sourceMap, outputSize := i.sourceMap, i.outputSize
+			i.sourceMap, i.outputSize = nil, nil
 			elVal, err := i.evaluatePV(th)
+			i.sourceMap, i.outputSize = sourceMap, outputSize
 			if err != nil {
 				i.stack.clearCurrentTrace()
 				return nil, err
 			}
+			sourceMap.push(strconv.Itoa(index))
 			elem, err := i.manifestJSON(elVal)
+			sourceMap.pop()
 			if err != nil {
 				i.stack.clearCurrentTrace()
 				return nil, err
@@ -744,13 +917,21 @@ func (i *interpreter) manifestJSON(v value) (interface{}, error) {
 		i.stack.setCurrentTrace(traceElement{
 			loc: &msg,
 		})
+		sourceMap, outputSize := i.sourceMap, i.outputSize
+		i.sourceMap, i.outputSize = nil, nil
 		err := checkAssertions(i, v)
+		i.sourceMap, i.outputSize = sourceMap, outputSize
 		if err != nil {
 			i.stack.clearCurrentTrace()
 			return nil, err
 		}
 		i.stack.clearCurrentTrace()
 
+		if len(fieldNames) == 0 {
+			if err := i.addOutputSize(len("{}")); err != nil {
+				return nil, err
+			}
+		}
 		result := make(map[string]interface{}, len(fieldNames))
 
 		for _, fieldName := range fieldNames {
@@ -758,13 +939,18 @@ func (i *interpreter) manifestJSON(v value) (interface{}, error) {
 			i.stack.setCurrentTrace(traceElement{
 				loc: &msg,
 			})
+			i.sourceMap, i.outputSize = nil, nil
 			fieldVal, err := v.index(i, fieldName)
+			i.sourceMap, i.outputSize = sourceMap, outputSize
 			if err != nil {
 				i.stack.clearCurrentTrace()
 				return nil, err
 			}
 
+			sourceMap.push(fieldName)
+			sourceMap.recordField(v, fieldName)
 			field, err := i.manifestJSON(fieldVal)
+			sourceMap.pop()
 			if err != nil {
 				i.stack.clearCurrentTrace()
 				return nil, err
@@ -891,11 +1077,39 @@ func (i *interpreter) manifestAndSerializeJSON(
 	return nil
 }
 
+// manifestOutput is like manifestJSON, but it enforces the output size limit
+// while the value is manifested, so that a too big output is never built.
+// Only the scalars and the empty arrays and objects are counted, which is
+// a lower bound of the size of the output in every mode. The exact size is
+// checked after the serialization.
+func (i *interpreter) manifestOutput(v value) (interface{}, error) {
+	outputSize := i.outputSize
+	size := 0
+	i.outputSize = &size
+	defer func() { i.outputSize = outputSize }()
+	return i.manifestJSON(v)
+}
+
+// manifestAndSerializeOutput manifests the result of the evaluation and
+// serializes it to buf as multiline JSON, enforcing the output size limit.
+func (i *interpreter) manifestAndSerializeOutput(buf *bytes.Buffer, v value) error {
+	manifested, err := i.manifestOutput(v)
+	if err != nil {
+		return err
+	}
+	serializeJSON(manifested, true, "", buf)
+	return i.checkOutputSize(buf.Len() + 1)
+}
+
 // manifestString expects the value to be a string and returns it.
 func (i *interpreter) manifestString(buf *bytes.Buffer, v value) error {
 	switch v := v.(type) {
 	case valueString:
-		buf.WriteString(v.getGoString())
+		str := v.getGoString()
+		if err := i.checkOutputSize(len(str) + 1); err != nil {
+			return err
+		}
+		buf.WriteString(str)
 		return nil
 	default:
 		return makeRuntimeError(fmt.Sprintf("expected string result, got: %s", v.getType().name), i.getCurrentStackTrace())
@@ -904,7 +1118,7 @@ func (i *interpreter) manifestString(buf *bytes.Buffer, v value) error {
 
 func (i *interpreter) manifestAndSerializeMulti(v value, stringOutputMode bool) (r map[string]string, err error) {
 	r = make(map[string]string)
-	json, err := i.manifestJSON(v)
+	json, err := i.manifestOutput(v)
 	if err != nil {
 		return r, err
 	}
@@ -938,7 +1152,7 @@ func (i *interpreter) manifestAndSerializeMulti(v value, stringOutputMode bool)
 
 func (i *interpreter) manifestAndSerializeYAMLStream(v value) (r []string, err error) {
 	r = make([]string, 0)
-	json, err := i.manifestJSON(v)
+	json, err := i.manifestOutput(v)
 	if err != nil {
 		return r, err
 	}
@@ -959,6 +1173,9 @@ func (i *interpreter) manifestAndSerializeYAMLStream(v value) (r []string, err e
 	return
 }
 
+// jsonToValue converts the standard Go representation of JSON to a Jsonnet
+// value. The nested strings and arrays are accounted for as allocations, the
+// result itself is accounted for by the caller, see allocatedResult.
 func jsonToValue(i *interpreter, v interface{}) (value, error) {
 	switch v := v.(type) {
 	case nil:
@@ -973,6 +1190,9 @@ func jsonToValue(i *interpreter, v interface{}) (value, error) {
 			}
 			elems[counter] = readyThunk(val)
 		}
+		if err := allocateElements(i, elems); err != nil {
+			return nil, err
+		}
 		return makeValueArray(elems), nil
 
 	case bool:
@@ -992,12 +1212,17 @@ func jsonToValue(i *interpreter, v interface{}) (value, error) {
 
 	case map[string]interface{}:
 		fieldMap := map[string]value{}
+		size := 0
 		for name, f := range v {
 			val, err := jsonToValue(i, f)
 			if err != nil {
 				return nil, err
 			}
 			fieldMap[name] = val
+			size += allocatedSize(val, nil)
+		}
+		if err := i.allocate(size); err != nil {
+			return nil, err
 		}
 		return buildObject(ast.ObjectFieldInherit, fieldMap), nil
 
@@ -1218,7 +1443,7 @@ func buildStdObject(i *interpreter) (*valueObject, error) {
 	}
 
 	for name, value := range builtinFields {
-		obj.fields[name] = simpleObjectField{value, ast.ObjectFieldHidden}
+		obj.fields[name] = simpleObjectField{value, ast.ObjectFieldHidden, nil}
 	}
 	return objVal.(*valueObject), nil
 }
@@ -1258,6 +1483,8 @@ func prepareExtVars(i *interpreter, ext vmExtMap, kind string) map[string]*cache
 			result[name] = codeToPV(i, diagnosticFile, content.value)
 		case extKindNode:
 			result[name] = nodeToPV(i, diagnosticFile, content.node)
+		case extKindValue:
+			result[name] = goValueToPV(i, content.goValue)
 		default:
 			result[name] = readyThunk(makeValueString(content.value))
 		}
@@ -1268,18 +1495,20 @@ func prepareExtVars(i *interpreter, ext vmExtMap, kind string) map[string]*cache
 func buildObject(hide ast.ObjectFieldHide, fields map[string]value) *valueObject {
 	fieldMap := simpleObjectFieldMap{}
 	for name, v := range fields {
-		fieldMap[name] = simpleObjectField{&readyValue{v}, hide}
+		fieldMap[name] = simpleObjectField{&readyValue{v}, hide, nil}
 	}
 	return makeValueSimpleObject(bindingFrame{}, fieldMap, nil, nil)
 }
 
-func buildInterpreter(ext vmExtMap, nativeFuncs map[string]*NativeFunction, maxStack int, ic *importCache, traceOut io.Writer, evalHook EvalHook) (*interpreter, error) {
+func buildInterpreter(ctx context.Context, ext vmExtMap, nativeFuncs map[string]evalCallable, maxStack int, limits evalLimits, ic *importCache, traceOut io.Writer, evalHook EvalHook) (*interpreter, error) {
 	i := interpreter{
 		stack:       makeCallStack(maxStack),
 		importCache: ic,
 		traceOut:    traceOut,
 		nativeFuncs: nativeFuncs,
 		evalHook:    evalHook,
+		ctx:         ctx,
+		limits:      limits,
 	}
 
 	stdObj, err := buildStdObject(&i)
@@ -1351,10 +1580,10 @@ func evaluateAux(i *interpreter, node ast.Node, tla vmExtMap) (value, error) {
 }
 
 // TODO(sbarzowski) this function takes far too many arguments - build interpreter in vm instead
-func evaluate(node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]*NativeFunction,
-	maxStack int, ic *importCache, traceOut io.Writer, stringOutputMode bool, evalHook EvalHook) (string, error) {
+func evaluate(ctx context.Context, node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]evalCallable,
+	maxStack int, limits evalLimits, ic *importCache, traceOut io.Writer, stringOutputMode bool, evalHook EvalHook) (string, error) {
 
-	i, err := buildInterpreter(ext, nativeFuncs, maxStack, ic, traceOut, evalHook)
+	i, err := buildInterpreter(ctx, ext, nativeFuncs, maxStack, limits, ic, traceOut, evalHook)
 	if err != nil {
 		return "", err
 	}
@@ -1369,7 +1598,7 @@ func evaluate(node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]
 	if stringOutputMode {
 		err = i.manifestString(&buf, result)
 	} else {
-		err = i.manifestAndSerializeJSON(&buf, result, true, "")
+		err = i.manifestAndSerializeOutput(&buf, result)
 	}
 	i.stack.clearCurrentTrace()
 	if err != nil {
@@ -1379,11 +1608,64 @@ func evaluate(node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]
 	return buf.String(), nil
 }
 
+// evaluateValue evaluates the node and returns the result in the standard
+// Go representation of JSON (as in "encoding/json" package).
+func evaluateValue(ctx context.Context, node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]evalCallable,
+	maxStack int, limits evalLimits, ic *importCache, traceOut io.Writer, evalHook EvalHook) (interface{}, error) {
+
+	i, err := buildInterpreter(ctx, ext, nativeFuncs, maxStack, limits, ic, traceOut, evalHook)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := evaluateAux(i, node, tla)
+	if err != nil {
+		return nil, err
+	}
+
+	i.stack.setCurrentTrace(manifestationTrace())
+	manifested, err := i.manifestOutput(result)
+	i.stack.clearCurrentTrace()
+	if err != nil {
+		return nil, err
+	}
+	return manifested, nil
+}
+
+// evaluateSourceMap is like evaluate in the JSON output mode, but it also
+// returns the source map of the output.
+func evaluateSourceMap(ctx context.Context, node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]evalCallable,
+	maxStack int, limits evalLimits, ic *importCache, traceOut io.Writer, evalHook EvalHook) (string, SourceMap, error) {
+
+	i, err := buildInterpreter(ctx, ext, nativeFuncs, maxStack, limits, ic, traceOut, evalHook)
+	if err != nil {
+		return "", nil, err
+	}
+
+	result, err := evaluateAux(i, node, tla)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var buf bytes.Buffer
+	sourceMap := make(SourceMap)
+	i.sourceMap = &sourceMapBuilder{sourceMap: sourceMap}
+	i.stack.setCurrentTrace(manifestationTrace())
+	err = i.manifestAndSerializeOutput(&buf, result)
+	i.stack.clearCurrentTrace()
+	i.sourceMap = nil
+	if err != nil {
+		return "", nil, err
+	}
+	buf.WriteString("\n")
+	return buf.String(), sourceMap, nil
+}
+
 // TODO(sbarzowski) this function takes far too many arguments - build interpreter in vm instead
-func evaluateMulti(node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]*NativeFunction,
-	maxStack int, ic *importCache, traceOut io.Writer, stringOutputMode bool, evalHook EvalHook) (map[string]string, error) {
+func evaluateMulti(ctx context.Context, node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]evalCallable,
+	maxStack int, limits evalLimits, ic *importCache, traceOut io.Writer, stringOutputMode bool, evalHook EvalHook) (map[string]string, error) {
 
-	i, err := buildInterpreter(ext, nativeFuncs, maxStack, ic, traceOut, evalHook)
+	i, err := buildInterpreter(ctx, ext, nativeFuncs, maxStack, limits, ic, traceOut, evalHook)
 	if err != nil {
 		return nil, err
 	}
@@ -1395,15 +1677,22 @@ func evaluateMulti(node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[st
 
 	i.stack.setCurrentTrace(manifestationTrace())
 	manifested, err := i.manifestAndSerializeMulti(result, stringOutputMode)
+	if err == nil {
+		size := 0
+		for _, content := range manifested {
+			size += len(content)
+		}
+		err = i.checkOutputSize(size)
+	}
 	i.stack.clearCurrentTrace()
 	return manifested, err
 }
 
 // TODO(sbarzowski) this function takes far too many arguments - build interpreter in vm instead
-func evaluateStream(node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]*NativeFunction,
-	maxStack int, ic *importCache, traceOut io.Writer, evalHook EvalHook) ([]string, error) {
+func evaluateStream(ctx context.Context, node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[string]evalCallable,
+	maxStack int, limits evalLimits, ic *importCache, traceOut io.Writer, evalHook EvalHook) ([]string, error) {
 
-	i, err := buildInterpreter(ext, nativeFuncs, maxStack, ic, traceOut, evalHook)
+	i, err := buildInterpreter(ctx, ext, nativeFuncs, maxStack, limits, ic, traceOut, evalHook)
 	if err != nil {
 		return nil, err
 	}
@@ -1415,6 +1704,13 @@ func evaluateStream(node ast.Node, ext vmExtMap, tla vmExtMap, nativeFuncs map[s
 
 	i.stack.setCurrentTrace(manifestationTrace())
 	manifested, err := i.manifestAndSerializeYAMLStream(result)
+	if err == nil {
+		size := 0
+		for _, doc := range manifested {
+			size += len(doc)
+		}
+		err = i.checkOutputSize(size)
+	}
 	i.stack.clearCurrentTrace()
 	return manifested, err
 }
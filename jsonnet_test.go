@@ -1,12 +1,26 @@
 package jsonnet
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 	"unicode/utf8"
 
 	"github.com/google/go-jsonnet/ast"
@@ -21,7 +35,7 @@ type errorFormattingTest struct {
 func genericTestErrorMessage(t *testing.T, tests []errorFormattingTest, format func(RuntimeError) string) {
 	for _, test := range tests {
 		vm := MakeVM()
-		rawOutput, err := vm.evaluateSnippet(ast.DiagnosticFileName(test.name), "", test.input, evalKindRegular)
+		rawOutput, err := vm.evaluateSnippet(context.Background(), ast.DiagnosticFileName(test.name), "", test.input, evalKindRegular)
 		var errString string
 		if err != nil {
 			switch typedErr := err.(type) {
@@ -350,3 +364,1879 @@ func TestSetTraceOut(t *testing.T) {
 		t.Errorf("Expected %q, but got %q", expected, actual)
 	}
 }
+
+func TestEvaluateContextCanceled(t *testing.T) {
+	vm := MakeVM()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := vm.EvaluateAnonymousSnippetContext(ctx, "test.jsonnet", `42`)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	var rtErr RuntimeError
+	if !errors.As(err, &rtErr) {
+		t.Errorf("expected RuntimeError, got %T", err)
+	}
+}
+
+func TestEvaluateContextDeadline(t *testing.T) {
+	vm := MakeVM()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// Tail-recursive, so it doesn't hit the stack limit; it would run for a very long time.
+	input := `local loop(n) = if n == 0 then 0 else loop(n - 1) tailstrict; loop(1e12)`
+	_, err := vm.EvaluateAnonymousSnippetContext(ctx, "loop.jsonnet", input)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	var rtErr RuntimeError
+	if !errors.As(err, &rtErr) {
+		t.Fatalf("expected RuntimeError, got %T", err)
+	}
+	if !strings.Contains(err.Error(), "loop.jsonnet:1:") {
+		t.Errorf("expected the stack trace to point into loop.jsonnet, got %v", err)
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(vm *VM)
+		input  string
+		target error
+	}{
+		{"steps", func(vm *VM) { vm.MaxSteps = 1000 }, `std.foldl(function(acc, x) acc + x, std.range(1, 1000), 0)`, ErrMaxStepsExceeded},
+		{"range", func(vm *VM) { vm.MaxAllocations = 1000 }, `std.length(std.range(1, 100000))`, ErrMaxAllocationsExceeded},
+		{"strings", func(vm *VM) { vm.MaxAllocations = 1000 }, `std.foldl(function(acc, x) acc + "xxxxxxxxxx", std.range(1, 100), "")`, ErrMaxAllocationsExceeded},
+		{"parsed json", func(vm *VM) { vm.MaxAllocations = 40 }, `std.parseJson('["aaaaaaaaaa", "bbbbbbbbbb"]')`, ErrMaxAllocationsExceeded},
+		{"split", func(vm *VM) { vm.MaxAllocations = 30 }, `std.splitLimit("aaaaaaaaaa,bbbbbbbbbb", ",", -1)`, ErrMaxAllocationsExceeded},
+		{"builtins", func(vm *VM) { vm.MaxAllocations = 1000 }, `std.length(std.foldl(function(acc, _) std.strReplace(acc, "x", "xx"), std.range(1, 20), "x"))`, ErrMaxAllocationsExceeded},
+		{"manifest", func(vm *VM) { vm.MaxAllocations = 1000 }, `std.length(std.manifestJsonEx(std.range(1, 200), "  "))`, ErrMaxAllocationsExceeded},
+		{"output", func(vm *VM) { vm.MaxOutputSize = 100 }, `std.makeArray(100, function(i) i)`, ErrMaxOutputSizeExceeded},
+		{"string output", func(vm *VM) { vm.MaxOutputSize = 100 }, `{ a: std.join("", std.makeArray(200, function(i) "x")) }`, ErrMaxOutputSizeExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := MakeVM()
+			_, err := vm.EvaluateAnonymousSnippet("limits.jsonnet", test.input)
+			if err != nil {
+				t.Fatalf("unexpected error without limits: %v", err)
+			}
+			test.setup(vm)
+			_, err = vm.EvaluateAnonymousSnippet("limits.jsonnet", test.input)
+			if !errors.Is(err, test.target) {
+				t.Errorf("expected %v, got %v", test.target, err)
+			}
+		})
+	}
+}
+
+// TestMaxAllocationsLinearFold checks that appending to a string in a fold
+// is accounted for as a linear number of allocations, since the
+// concatenations share the appended strings.
+func TestMaxAllocationsLinearFold(t *testing.T) {
+	const n = 10000
+	vm := MakeVM()
+	vm.MaxAllocations = 10 * n
+	actual, err := vm.EvaluateAnonymousSnippet("limits.jsonnet", fmt.Sprintf(`std.length(std.foldl(function(acc, x) acc + "xx", std.range(1, %d), ""))`, n))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := fmt.Sprintf("%d\n", 2*n); actual != expected {
+		t.Errorf("Expected %q, but got %q", expected, actual)
+	}
+}
+
+func TestMaxOutputSizeValue(t *testing.T) {
+	vm := MakeVM()
+	vm.MaxOutputSize = 100
+	const input = `{ a: std.join("", std.makeArray(200, function(i) "x")) }`
+	if _, err := vm.EvaluateAnonymousSnippetValue("limits.jsonnet", input); !errors.Is(err, ErrMaxOutputSizeExceeded) {
+		t.Errorf("EvaluateAnonymousSnippetValue: expected %v, got %v", ErrMaxOutputSizeExceeded, err)
+	}
+	val, err := vm.EvaluateAnonymousSnippetLazy("limits.jsonnet", input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := val.Manifest(); !errors.Is(err, ErrMaxOutputSizeExceeded) {
+		t.Errorf("Value.Manifest: expected %v, got %v", ErrMaxOutputSizeExceeded, err)
+	}
+}
+
+func TestResourceLimitsNotExceeded(t *testing.T) {
+	vm := MakeVM()
+	vm.MaxSteps = 10000
+	vm.MaxAllocations = 10000
+	vm.MaxOutputSize = 10000
+	actual, err := vm.EvaluateAnonymousSnippet("limits.jsonnet", `{ a: [1, 2, 3], b: "x" + "y" }`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{ "a": [ 1, 2, 3 ], "b": "xy" }`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+}
+
+func TestEvaluateValue(t *testing.T) {
+	vm := MakeVM()
+	actual, err := vm.EvaluateAnonymousSnippetValue("value.jsonnet", `{ a: [1, "x", true, null], b: { c: 2.5 }, h:: 42 }`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"a": []interface{}{1.0, "x", true, nil},
+		"b": map[string]interface{}{"c": 2.5},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %#v, but got %#v", expected, actual)
+	}
+}
+
+func TestEvaluateInto(t *testing.T) {
+	type Port struct {
+		Name string `json:"name"`
+		Port uint16 `json:"port"`
+	}
+	type Meta struct {
+		Labels map[string]string `json:"labels"`
+	}
+	type Service struct {
+		Meta
+		Replicas int             `json:"replicas"`
+		Ports    []Port          `json:"ports"`
+		Weight   *float64        `json:"weight"`
+		Enabled  bool            `json:"enabled"`
+		Ignored  string          `json:"-"`
+		Raw      json.RawMessage `json:"raw"`
+		Version  int             `json:"version,string"`
+	}
+	vm := MakeVM()
+	var actual Service
+	err := vm.EvaluateAnonymousSnippetInto("into.jsonnet", `{
+		labels: { app: "web" },
+		replicas: 3,
+		ports: [{ name: "http", port: 80 }],
+		weight: 0.5,
+		enabled: true,
+		Ignored: "x",
+		raw: { x: 1 },
+		version: "2",
+		unknown: "ignored",
+	}`, &actual)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	weight := 0.5
+	expected := Service{
+		Meta:     Meta{Labels: map[string]string{"app": "web"}},
+		Replicas: 3,
+		Ports:    []Port{{Name: "http", Port: 80}},
+		Weight:   &weight,
+		Enabled:  true,
+		Raw:      json.RawMessage(`{"x":1}`),
+		Version:  2,
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %#v, but got %#v", expected, actual)
+	}
+}
+
+func TestEvaluateIntoErrors(t *testing.T) {
+	type Target struct {
+		Ports []struct {
+			Port uint16 `json:"port"`
+		} `json:"ports"`
+	}
+	tests := []struct {
+		input    string
+		value    string
+		expected string
+	}{
+		{`{ ports: [{ port: "80" }] }`, "string", "uint16"},
+		{`{ ports: [{ port: 1.5 }] }`, "number 1.5", "uint16"},
+		{`{ ports: [{ port: 70000 }] }`, "number 70000", "uint16"},
+		{`{ ports: {} }`, "object", `[]struct { Port uint16 "json:\"port\"" }`},
+	}
+	for _, test := range tests {
+		var target Target
+		err := MakeVM().EvaluateAnonymousSnippetInto("into.jsonnet", test.input, &target)
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			t.Errorf("expected a type error for %s, got %v", test.input, err)
+			continue
+		}
+		if typeErr.Value != test.value || typeErr.Type.String() != test.expected {
+			t.Errorf("Expected %s into %s, but got %q", test.value, test.expected, err.Error())
+		}
+	}
+	var target Target
+	if err := MakeVM().EvaluateAnonymousSnippetInto("into.jsonnet", `{}`, target); err == nil {
+		t.Errorf("expected error when decoding into a non-pointer")
+	}
+
+	// Embedded pointers to unexported structs cannot be set.
+	type meta struct {
+		Name string `json:"name"`
+	}
+	var embedded struct {
+		*meta
+		X int `json:"x"`
+	}
+	err := MakeVM().EvaluateAnonymousSnippetInto("into.jsonnet", `{ name: "a", x: 1 }`, &embedded)
+	if err == nil || !strings.Contains(err.Error(), "unexported") {
+		t.Errorf("expected an error about the unexported embedded struct, got %v", err)
+	}
+}
+
+type upperText string
+
+func (u *upperText) UnmarshalText(text []byte) error {
+	*u = upperText(strings.ToUpper(string(text)))
+	return nil
+}
+
+// TestDecodeIntoMatchesJSON checks that decodeInto stores the values like
+// json.Unmarshal would.
+func TestDecodeIntoMatchesJSON(t *testing.T) {
+	type Inner struct {
+		A int `json:"a"`
+		B string
+	}
+	type Other struct {
+		A string `json:"a"`
+		C bool
+	}
+	type Tagged struct {
+		B string `json:"B"`
+	}
+	type Target struct {
+		Inner
+		*Other
+		Tagged
+		Name    string               `json:"name,omitempty"`
+		Count   uint8                `json:"count,string"`
+		Data    []byte               `json:"data"`
+		Pair    [2]int               `json:"pair"`
+		Any     interface{}          `json:"any"`
+		Ptr     *float64             `json:"ptr"`
+		Number  json.Number          `json:"number"`
+		Keys    map[upperText]int    `json:"keys"`
+		Ints    map[int8]bool        `json:"ints"`
+		Text    upperText            `json:"text"`
+		When    time.Time            `json:"when"`
+		Nested  []map[string]*Inner  `json:"nested"`
+		Skipped string               `json:"-"`
+		Dash    string               `json:"-,"`
+		Rest    map[string]string    `json:"rest"`
+		Float   float32              `json:"float"`
+		Raw     json.RawMessage      `json:"raw"`
+		Ifaces  []interface{}        `json:"ifaces"`
+		Objects map[string][]float64 `json:"objects"`
+	}
+	inputs := []string{
+		`{"a": 1, "B": "tagged", "C": true, "name": "x", "count": "7", "data": "aGVsbG8=", "pair": [1, 2, 3]}`,
+		`{"A": "two", "b": "folded", "NAME": "upper", "pair": [5], "any": {"x": [1, "y", null]}, "ptr": 2.5}`,
+		`{"number": 12.5, "keys": {"a": 1}, "ints": {"-3": true}, "text": "abc", "when": "2024-01-02T03:04:05Z"}`,
+		`{"nested": [{"x": {"a": 1, "B": "b"}, "y": null}], "Skipped": "no", "-": "dash", "rest": {"k": "v"}}`,
+		`{"float": 1.5, "raw": {"z":[true]}, "ifaces": [1, "a", {}], "objects": {"o": [1, 2]}, "ptr": null}`,
+		`{"a": "wrong"}`,
+		`{"pair": {}}`,
+		`{"ints": {"300": true}}`,
+		`{"count": "1.5"}`,
+		`{"nested": [{"x": {"a": 1.5}}]}`,
+		`{"keys": []}`,
+		`{"text": 1}`,
+		`{"number": "12"}`,
+		`{"when": "yesterday"}`,
+		`{"Other": {"C": true}, "Inner": {"a": 3}, "objects": {"o": "x"}}`,
+	}
+	for _, input := range inputs {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(input), &parsed); err != nil {
+			t.Fatal(err)
+		}
+		var expected, actual Target
+		expectedErr := json.Unmarshal([]byte(input), &expected)
+		actualErr := decodeInto(parsed, &actual)
+		var expectedTypeErr, actualTypeErr *json.UnmarshalTypeError
+		switch {
+		case (actualErr == nil) != (expectedErr == nil):
+			t.Errorf("%s: expected error %v, but got %v", input, expectedErr, actualErr)
+		case errors.As(expectedErr, &expectedTypeErr):
+			if !errors.As(actualErr, &actualTypeErr) || actualTypeErr.Value != expectedTypeErr.Value ||
+				actualTypeErr.Type != expectedTypeErr.Type {
+				t.Errorf("%s: expected error %v, but got %v", input, expectedErr, actualErr)
+			}
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %#v, but got %#v", input, expected, actual)
+		}
+	}
+}
+
+func TestLazyValue(t *testing.T) {
+	vm := MakeVM()
+	val, err := vm.EvaluateAnonymousSnippetLazy("lazy.jsonnet", `{
+		deployment: { replicas: 3, name: "web" },
+		broken: error "should not be evaluated",
+		list: [1, error "neither this", "x"],
+		hidden:: true,
+		add(a, b):: a + b,
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if typ, err := val.Type(); err != nil || typ != "object" {
+		t.Errorf("Expected %q, but got %q (%v)", "object", typ, err)
+	}
+
+	fields, err := val.Fields()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"broken", "deployment", "list"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, but got %v", expected, fields)
+	}
+	fields, err = val.FieldsAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"add", "broken", "deployment", "hidden", "list"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, but got %v", expected, fields)
+	}
+
+	deployment, err := val.Field("deployment")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	replicas, err := deployment.Field("replicas")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n, err := replicas.AsNumber(); err != nil || n != 3 {
+		t.Errorf("Expected 3, but got %v (%v)", n, err)
+	}
+
+	list, err := val.Field("list")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n, err := list.Len(); err != nil || n != 3 {
+		t.Errorf("Expected 3, but got %v (%v)", n, err)
+	}
+	elem, err := list.Index(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s, err := elem.AsString(); err != nil || s != "x" {
+		t.Errorf("Expected %q, but got %q (%v)", "x", s, err)
+	}
+	if _, err := list.Index(1); err == nil || !strings.Contains(err.Error(), "neither this") {
+		t.Errorf("expected an error from the second element, got %v", err)
+	}
+
+	hidden, err := val.Field("hidden")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, err := hidden.AsBool(); err != nil || !b {
+		t.Errorf("Expected true, but got %v (%v)", b, err)
+	}
+
+	add, err := val.Field("add")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if typ, err := add.Type(); err != nil || typ != "function" {
+		t.Errorf("Expected %q, but got %q (%v)", "function", typ, err)
+	}
+	sum, err := add.Call(40, replicas)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n, err := sum.AsNumber(); err != nil || n != 43 {
+		t.Errorf("Expected 43, but got %v (%v)", n, err)
+	}
+
+	manifested, err := deployment.Manifest()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]interface{}{"replicas": 3.0, "name": "web"}; !reflect.DeepEqual(manifested, expected) {
+		t.Errorf("Expected %v, but got %v", expected, manifested)
+	}
+	if _, err := val.Manifest(); err == nil || !strings.Contains(err.Error(), "should not be evaluated") {
+		t.Errorf("expected an error from the broken field, got %v", err)
+	}
+	if _, err := replicas.AsString(); err == nil {
+		t.Errorf("expected a type error")
+	}
+	if _, err := val.Field("missing"); err == nil || !strings.Contains(err.Error(), "Field does not exist: missing") {
+		t.Errorf("expected a missing field error, got %v", err)
+	}
+
+	other, err := vm.EvaluateAnonymousSnippetLazy("other.jsonnet", `1`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := add.Call(other, 1); err == nil || !strings.Contains(err.Error(), "different evaluation") {
+		t.Errorf("expected a Value from another evaluation to be rejected, got %v", err)
+	}
+}
+
+func TestLazyValueContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	val, err := MakeVM().EvaluateAnonymousSnippetLazyContext(ctx, "lazy.jsonnet", `{
+		loop: std.foldl(function(acc, x) acc + x, std.range(1, 100000), 0),
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cancel()
+	if _, err := val.Field("loop"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCompileProgram(t *testing.T) {
+	p, err := MakeVM().Compile("program.jsonnet", `function(name) { greeting: "Hello " + name, env: std.extVar("env") }`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			vm := MakeVM()
+			vm.ExtVar("env", "prod")
+			vm.TLAVar("name", fmt.Sprintf("user%d", n))
+			actual, err := vm.EvaluateProgram(p)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			expected := fmt.Sprintf(`{ "env": "prod", "greeting": "Hello user%d" }`, n)
+			if removeExcessiveWhitespace(actual) != expected {
+				t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+func TestCompileProgramError(t *testing.T) {
+	_, err := MakeVM().Compile("program.jsonnet", `{ a: }`)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "program.jsonnet:1:") {
+		t.Errorf("expected the error to point into program.jsonnet, got %v", err)
+	}
+}
+
+func TestCloneConcurrent(t *testing.T) {
+	vm := MakeVM()
+	vm.Importer(&MemoryImporter{Data: map[string]Contents{
+		"lib.libsonnet": MakeContents(`{ greeting(name): "Hello " + name + " from " + std.extVar("env") }`),
+	}})
+	vm.ExtVar("env", "base")
+	p, err := vm.Compile("main.jsonnet", `(import "lib.libsonnet").greeting(std.extVar("name"))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		clone := vm.Clone()
+		clone.ExtVar("name", fmt.Sprintf("user%d", n))
+		wg.Add(1)
+		go func(n int, clone *VM) {
+			defer wg.Done()
+			for round := 0; round < 10; round++ {
+				actual, err := clone.EvaluateProgram(p)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				expected := fmt.Sprintf("\"Hello user%d from base\"\n", n)
+				if actual != expected {
+					t.Errorf("Expected %q, but got %q", expected, actual)
+					return
+				}
+			}
+		}(n, clone)
+	}
+	wg.Wait()
+
+	if _, err := vm.EvaluateProgram(p); err == nil || !strings.Contains(err.Error(), "Undefined external variable: name") {
+		t.Errorf("expected the clones not to change the original VM, got %v", err)
+	}
+}
+
+// blockingImporter blocks the import of one path until it is released.
+type blockingImporter struct {
+	MemoryImporter
+	blocked string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (importer *blockingImporter) Import(importedFrom, importedPath string) (Contents, string, error) {
+	if importedPath == importer.blocked {
+		close(importer.started)
+		<-importer.release
+	}
+	return importer.MemoryImporter.Import(importedFrom, importedPath)
+}
+
+func TestCloneImportDoesNotBlockCachedImports(t *testing.T) {
+	importer := &blockingImporter{
+		MemoryImporter: MemoryImporter{Data: map[string]Contents{
+			"lib.libsonnet":  MakeContents(`{ a: 1 }`),
+			"slow.libsonnet": MakeContents(`{ b: 2 }`),
+		}},
+		blocked: "slow.libsonnet",
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	vm := MakeVM()
+	vm.Importer(importer)
+	if _, err := vm.EvaluateAnonymousSnippet("main.jsonnet", `import "lib.libsonnet"`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	slow := vm.Clone()
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := slow.EvaluateAnonymousSnippet("slow.jsonnet", `import "slow.libsonnet"`)
+		slowDone <- err
+	}()
+	<-importer.started
+
+	fast := vm.Clone()
+	fastDone := make(chan error, 1)
+	go func() {
+		_, err := fast.EvaluateAnonymousSnippet("main.jsonnet", `import "lib.libsonnet"`)
+		fastDone <- err
+	}()
+	select {
+	case err := <-fastDone:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("a cached import waited for the import of another file")
+	}
+
+	close(importer.release)
+	if err := <-slowDone; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtValueTLAValue(t *testing.T) {
+	type Port struct {
+		Name     string `json:"name"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol,omitempty"`
+	}
+	type Config struct {
+		Replicas int               `json:"replicas"`
+		Ports    []Port            `json:"ports"`
+		Labels   map[string]string `json:"labels"`
+		Weights  map[int]float64   `json:"weights"`
+		Owner    *string           `json:"owner"`
+		Enabled  bool
+		Skipped  string    `json:"-"`
+		Created  time.Time `json:"created"`
+	}
+	vm := MakeVM()
+	vm.ExtValue("config", Config{
+		Replicas: 3,
+		Ports:    []Port{{Name: "http", Port: 80}},
+		Labels:   map[string]string{"app": "web"},
+		Weights:  map[int]float64{1: 0.5},
+		Enabled:  true,
+		Skipped:  "x",
+		Created:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	vm.TLAValue("extra", []interface{}{1, "two", map[string]bool{"three": true}})
+	actual, err := vm.EvaluateAnonymousSnippet("ext.jsonnet", `function(extra) { config: std.extVar("config"), extra: extra }`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{ "config": { "Enabled": true, "created": "2024-01-02T03:04:05Z", "labels": { "app": "web" }, "owner": null, ` +
+		`"ports": [ { "name": "http", "port": 80 } ], "replicas": 3, "weights": { "1": 0.5 } }, ` +
+		`"extra": [ 1, "two", { "three": true } ] }`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+}
+
+type upperKey string
+
+func (u upperKey) MarshalText() ([]byte, error) {
+	return []byte(strings.ToUpper(string(u))), nil
+}
+
+type pointKey struct{ X, Y int }
+
+func (p pointKey) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d,%d", p.X, p.Y)), nil
+}
+
+type pointerMarshaler struct{ X int }
+
+func (p *pointerMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"pointer": %d}`, p.X)), nil
+}
+
+// TestExtValueMatchesJSON checks that the Go values are converted like
+// json.Marshal would convert them.
+func TestExtValueMatchesJSON(t *testing.T) {
+	type Inner struct {
+		A int `json:"a"`
+		B string
+	}
+	type Other struct {
+		A string `json:"a"`
+		C bool   `json:",omitempty"`
+	}
+	type Target struct {
+		Inner
+		*Other
+		Name     string             `json:"name,omitempty"`
+		Count    uint8              `json:"count,string"`
+		Label    *string            `json:"label,string"`
+		Data     []byte             `json:"data"`
+		Pair     [2]int             `json:"pair"`
+		Any      interface{}        `json:"any"`
+		Ptr      *float64           `json:"ptr,omitempty"`
+		Number   json.Number        `json:"number"`
+		Keys     map[pointKey]int   `json:"keys"`
+		Ints     map[int8]bool      `json:"ints"`
+		Text     upperKey           `json:"text"`
+		When     time.Time          `json:"when"`
+		Nested   []map[string]Inner `json:"nested,omitempty"`
+		Skipped  string             `json:"-"`
+		Dash     string             `json:"-,"`
+		Float    float32            `json:"float"`
+		Raw      json.RawMessage    `json:"raw"`
+		Pointer  pointerMarshaler   `json:"pointer"`
+		Empty    struct{}           `json:"empty,omitempty"`
+		hidden   int
+		Exported int `json:"exported"`
+	}
+	label := "quoted"
+	weight := 0.25
+	values := []interface{}{
+		Target{},
+		&Target{
+			Inner:   Inner{A: 1, B: "b"},
+			Other:   &Other{A: "shadowed", C: true},
+			Name:    "x",
+			Count:   7,
+			Label:   &label,
+			Data:    []byte("hello"),
+			Pair:    [2]int{1, 2},
+			Any:     map[string]interface{}{"x": []interface{}{1, "y", nil}},
+			Ptr:     &weight,
+			Number:  "12.5",
+			Keys:    map[pointKey]int{{1, 2}: 1},
+			Ints:    map[int8]bool{-3: true},
+			Text:    "abc",
+			When:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Nested:  []map[string]Inner{{"x": {A: 2}}},
+			Skipped: "no",
+			Dash:    "dash",
+			Float:   1.5,
+			Raw:     json.RawMessage(`{"z":[true]}`),
+			Pointer: pointerMarshaler{X: 3},
+			hidden:  4,
+		},
+		[]Target{{Name: "in a slice", Pointer: pointerMarshaler{X: 5}}},
+		map[string]*pointerMarshaler{"p": {X: 6}, "nil": nil},
+		[]uint{1, 2},
+		[]interface{}{nil, true, []string{}},
+		map[string]interface{}{"nil": map[string]int(nil), "bytes": []byte{}},
+	}
+	for _, v := range values {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm := MakeVM()
+		expected, err := vm.EvaluateAnonymousSnippet("expected.jsonnet", string(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm.ExtValue("v", v)
+		actual, err := vm.EvaluateAnonymousSnippet("actual.jsonnet", `std.extVar("v")`)
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", v, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%#v: expected %s, but got %s", v, expected, actual)
+		}
+	}
+}
+
+func TestExtValueCycle(t *testing.T) {
+	type Node struct {
+		Next *Node `json:"next"`
+	}
+	node := &Node{}
+	node.Next = node
+	vm := MakeVM()
+	vm.ExtValue("node", node)
+	_, err := vm.EvaluateAnonymousSnippet("ext.jsonnet", `std.extVar("node")`)
+	if err == nil || !strings.Contains(err.Error(), "encountered a cycle") {
+		t.Errorf("expected an error about the cycle, got %v", err)
+	}
+}
+
+func TestExtValueUnsupported(t *testing.T) {
+	vm := MakeVM()
+	vm.ExtValue("ch", make(chan int))
+	_, err := vm.EvaluateAnonymousSnippet("ext.jsonnet", `std.extVar("ch")`)
+	if err == nil || !strings.Contains(err.Error(), "Cannot convert Go value of type chan int") {
+		t.Errorf("expected a conversion error, got %v", err)
+	}
+	_, err = vm.EvaluateAnonymousSnippet("ext.jsonnet", `42`)
+	if err != nil {
+		t.Errorf("unused external variables should not be converted, got %v", err)
+	}
+}
+
+func TestNativeFunctionResultNotJSON(t *testing.T) {
+	vm := MakeVM()
+	vm.NativeFunction(&NativeFunction{
+		Name: "point",
+		Func: func(args []interface{}) (interface{}, error) {
+			return struct{ X int }{X: 1}, nil
+		},
+	})
+	_, err := vm.EvaluateAnonymousSnippet("native.jsonnet", `std.native("point")()`)
+	if err == nil || !strings.Contains(err.Error(), "Not a json type") {
+		t.Errorf("expected only JSON values to be accepted, got %v", err)
+	}
+}
+
+func TestLazyNativeFunction(t *testing.T) {
+	vm := MakeVM()
+	vm.LazyNativeFunction(&LazyNativeFunction{
+		Name:   "sortBy",
+		Params: ast.Identifiers{"keyF", "arr"},
+		Func: func(args []*Value) (interface{}, error) {
+			keyF, arr := args[0], args[1]
+			n, err := arr.Len()
+			if err != nil {
+				return nil, err
+			}
+			type item struct {
+				key  float64
+				elem *Value
+			}
+			items := make([]item, n)
+			for index := range items {
+				elem, err := arr.Index(index)
+				if err != nil {
+					return nil, err
+				}
+				key, err := keyF.Call(elem)
+				if err != nil {
+					return nil, err
+				}
+				k, err := key.AsNumber()
+				if err != nil {
+					return nil, err
+				}
+				items[index] = item{key: k, elem: elem}
+			}
+			sort.SliceStable(items, func(a, b int) bool { return items[a].key < items[b].key })
+			result := make([]interface{}, n)
+			for index, it := range items {
+				result[index] = it.elem
+			}
+			return result, nil
+		},
+	})
+	vm.LazyNativeFunction(&LazyNativeFunction{
+		Name:   "first",
+		Params: ast.Identifiers{"a", "b"},
+		Func: func(args []*Value) (interface{}, error) {
+			return args[0], nil
+		},
+	})
+	vm.LazyNativeFunction(&LazyNativeFunction{
+		Name:   "hidden",
+		Params: ast.Identifiers{"obj"},
+		Func: func(args []*Value) (interface{}, error) {
+			return args[0].FieldsAll()
+		},
+	})
+
+	input := `{
+		sorted: std.native("sortBy")(function(x) x.k, [{ k: 3 }, { k: 1 }, { k: 2, h:: "hidden" }]),
+		first: std.native("first")(1, error "not forced"),
+		hidden: std.native("hidden")({ a: 1, b:: 2 }),
+	}`
+	actual, err := vm.EvaluateAnonymousSnippet("native.jsonnet", input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{ "first": 1, "hidden": [ "a", "b" ], "sorted": [ { "k": 1 }, { "k": 2 }, { "k": 3 } ] }`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+
+	_, err = vm.EvaluateAnonymousSnippet("native.jsonnet", `std.native("sortBy")(function(x) error "bad key", [1, 2])`)
+	if err == nil || !strings.Contains(err.Error(), "bad key") || !strings.Contains(err.Error(), "native.jsonnet:1:") {
+		t.Errorf("expected an error from the callback, got %v", err)
+	}
+}
+
+func TestMakeNativeFunction(t *testing.T) {
+	type Options struct {
+		Suffix string `json:"suffix"`
+		Upper  bool   `json:"upper"`
+	}
+	type Result struct {
+		Text  string `json:"text"`
+		Count int    `json:"count"`
+	}
+	greet, err := MakeNativeFunction("greet", func(name string, n int, opts Options) (Result, error) {
+		if n < 0 {
+			return Result{}, fmt.Errorf("negative count: %d", n)
+		}
+		text := strings.Repeat("hello "+name+opts.Suffix+" ", n)
+		if opts.Upper {
+			text = strings.ToUpper(text)
+		}
+		return Result{Text: strings.TrimSpace(text), Count: n}, nil
+	}, "name", "n", "opts")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	apply, err := MakeNativeFunction("apply", func(f *Value, x float64) *Value {
+		result, err := f.Call(x)
+		if err != nil {
+			panic(err)
+		}
+		return result
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vm := MakeVM()
+	vm.LazyNativeFunction(greet)
+	vm.LazyNativeFunction(apply)
+
+	actual, err := vm.EvaluateAnonymousSnippet("native.jsonnet", `[
+		std.native("greet")("bob", 2, { suffix: "!", upper: true }),
+		std.native("greet")(opts={}, n=1, name="alice"),
+		std.native("apply")(function(x) x * 2, 21),
+	]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `[ { "count": 2, "text": "HELLO BOB! HELLO BOB!" }, { "count": 1, "text": "hello alice" }, 42 ]`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`std.native("greet")("bob", "2", {})`, `native function "greet", parameter n: json: cannot unmarshal string into Go value of type int`},
+		{`std.native("greet")("bob", 1, { upper: 1 })`, `native function "greet", parameter opts: json: cannot unmarshal number into Go struct field Options.upper of type bool`},
+		{`std.native("greet")("bob", -1, {})`, `negative count: -1`},
+	}
+	for _, test := range errorTests {
+		_, err := vm.EvaluateAnonymousSnippet("native.jsonnet", test.input)
+		if err == nil {
+			t.Errorf("expected error for %s", test.input)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) || !strings.Contains(err.Error(), "native.jsonnet:1:1-") {
+			t.Errorf("Expected an error containing %q at the call site, but got %q", test.expected, err.Error())
+		}
+	}
+
+	for _, f := range []interface{}{42, func() {}, func() error { return nil }} {
+		if _, err := MakeNativeFunction("bad", f); err == nil {
+			t.Errorf("expected error for %T", f)
+		}
+	}
+	if _, err := MakeNativeFunction("bad", func(a, b int) int { return a + b }, "a"); err == nil {
+		t.Errorf("expected error for mismatched parameter names")
+	}
+}
+
+func TestNativeFunctionDefaultsVariadic(t *testing.T) {
+	vm := MakeVM()
+	vm.NativeFunction(&NativeFunction{
+		Name:     "join",
+		Params:   ast.Identifiers{"sep", "prefix", "parts"},
+		Defaults: map[ast.Identifier]interface{}{"sep": ",", "prefix": ""},
+		Variadic: true,
+		Func: func(args []interface{}) (interface{}, error) {
+			var parts []string
+			for _, part := range args[2].([]interface{}) {
+				parts = append(parts, part.(string))
+			}
+			return args[1].(string) + strings.Join(parts, args[0].(string)), nil
+		},
+	})
+	sum, err := MakeNativeFunction("sum", func(base float64, xs ...float64) float64 {
+		for _, x := range xs {
+			base += x
+		}
+		return base
+	}, "base", "xs")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vm.LazyNativeFunction(sum)
+
+	actual, err := vm.EvaluateAnonymousSnippet("native.jsonnet", `[
+		std.native("join")(),
+		std.native("join")("-"),
+		std.native("join")("-", ">", "a", "b", "c"),
+		std.native("join")(prefix=">"),
+		std.native("sum")(1),
+		std.native("sum")(1, 2, 3),
+	]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `[ "", "", ">a-b-c", ">", 1, 6 ]`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`std.native("sum")()`, "Missing argument: base"},
+		{`std.native("sum")(xs=[1])`, "function has no parameter xs"},
+		{`std.native("join")("-", sep=",")`, "Argument sep already provided"},
+	}
+	for _, test := range errorTests {
+		_, err := vm.EvaluateAnonymousSnippet("native.jsonnet", test.input)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected an error containing %q, but got %v", test.expected, err)
+		}
+	}
+
+	sigs := vm.NativeSignatures()
+	if sig := sigs["join"]; !sig.Variadic || len(sig.Params) != 3 || sig.Params[0].DefaultArg == nil || sig.Params[2].DefaultArg != nil {
+		t.Errorf("unexpected signature of join: %+v", sig)
+	}
+}
+
+func TestFSImporter(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.jsonnet":               {Data: []byte(`{ local lib = import "lib/util.libsonnet", util: lib, vendored: import "vendored.libsonnet", abs: (importstr "/lib/data.txt") == (importstr "lib/data.txt") }`)},
+		"lib/util.libsonnet":         {Data: []byte(`{ name: importstr "data.txt", sibling: (import "../other.libsonnet").x }`)},
+		"lib/data.txt":               {Data: []byte("util")},
+		"other.libsonnet":            {Data: []byte(`{ x: 42 }`)},
+		"vendor/vendored.libsonnet":  {Data: []byte(`"from vendor"`)},
+		"vendor2/vendored.libsonnet": {Data: []byte(`"from vendor2"`)},
+	}
+	vm := MakeVM()
+	vm.Importer(&FSImporter{FS: fsys, JPaths: []string{"vendor", "vendor2"}})
+	actual, err := vm.EvaluateFile("main.jsonnet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{ "abs": true, "util": { "name": "util", "sibling": 42 }, "vendored": "from vendor2" }`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+
+	_, err = vm.EvaluateAnonymousSnippet("snippet.jsonnet", `import "../../main.jsonnet"`)
+	if err == nil || !strings.Contains(err.Error(), `couldn't open import "../../main.jsonnet"`) {
+		t.Errorf("expected an import error, got %v", err)
+	}
+}
+
+func writeTestZip(t *testing.T, filename string, files map[string]string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, data := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTarGz(t *testing.T, filename string, files map[string]string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	w := tar.NewWriter(gz)
+	for name, data := range files {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveImports(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "lib.zip")
+	writeTestZip(t, zipPath, map[string]string{
+		"util/util.libsonnet":   `{ name: "util", helper: import "helper.libsonnet", other: import "other.libsonnet" }`,
+		"util/helper.libsonnet": `importstr "data.txt"`,
+		"util/data.txt":         "helper",
+	})
+	tarPath := filepath.Join(dir, "other.tar.gz")
+	writeTestTarGz(t, tarPath, map[string]string{
+		"./other.libsonnet": `"other"`,
+	})
+
+	vm := MakeVM()
+	vm.Importer(&FileImporter{JPaths: []string{zipPath, tarPath}})
+	actual, err := vm.EvaluateAnonymousSnippet("main.jsonnet", `import "util/util.libsonnet"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{ "helper": "helper", "name": "util", "other": "other" }`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+
+	_, err = vm.EvaluateAnonymousSnippet("main.jsonnet", `import "missing.libsonnet"`)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	for _, expected := range []string{
+		fmt.Sprintf(`entry "missing.libsonnet" in archive %#v`, zipPath),
+		fmt.Sprintf(`entry "missing.libsonnet" in archive %#v`, tarPath),
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected the error to contain %q, got %v", expected, err)
+		}
+	}
+
+	brokenPath := filepath.Join(dir, "broken.zip")
+	if err := os.WriteFile(brokenPath, []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vm.Importer(&FileImporter{JPaths: []string{brokenPath}})
+	_, err = vm.EvaluateAnonymousSnippet("main.jsonnet", `import "x.libsonnet"`)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("reading archive %#v", brokenPath)) {
+		t.Errorf("expected an error about the broken archive, got %v", err)
+	}
+}
+
+func TestImportMap(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"vendor/k8s/apps.libsonnet":    `{ kind: "apps", util: import "util.libsonnet" }`,
+		"vendor/k8s/util.libsonnet":    `"k8s util"`,
+		"vendor/k8s/v2/apps.libsonnet": `{ kind: "apps v2" }`,
+		"vendor/k/main.libsonnet":      `"k"`,
+		"jpath/k8s/apps.libsonnet":     `{ kind: "from jpath" }`,
+		"jpath/other.libsonnet":        `"other"`,
+		"importmap.json":               `{ "imports": { "k8s/": "vendor/k8s/", "k8s/v2/": "vendor/k8s/v2/", "k.libsonnet": "vendor/k/main.libsonnet" } }`,
+		"broken.json":                  `{ "imports": { "k8s/": "vendor/k8s" } }`,
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	importMap, err := LoadImportMap(filepath.Join(dir, "importmap.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vm := MakeVM()
+	vm.Importer(&ImportMapImporter{
+		Importer: &FileImporter{JPaths: []string{filepath.Join(dir, "jpath")}},
+		Map:      importMap,
+	})
+	actual, err := vm.EvaluateAnonymousSnippet("main.jsonnet", `[import "k8s/apps.libsonnet", import "k8s/v2/apps.libsonnet", import "k.libsonnet", import "other.libsonnet"]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `[ { "kind": "apps", "util": "k8s util" }, { "kind": "apps v2" }, "k", "other" ]`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+
+	_, err = vm.EvaluateAnonymousSnippet("main.jsonnet", `import "k8s/missing.libsonnet"`)
+	if err == nil || !strings.Contains(err.Error(), `import "k8s/missing.libsonnet" mapped to`) {
+		t.Errorf("expected an error about the mapped import, got %v", err)
+	}
+
+	deps, err := vm.FindDependencies("", []string{filepath.Join(dir, "vendor/k8s/apps.libsonnet")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedDeps := []string{filepath.Join(dir, "vendor/k8s/util.libsonnet")}
+	if !reflect.DeepEqual(deps, expectedDeps) {
+		t.Errorf("Expected %v, but got %v", expectedDeps, deps)
+	}
+
+	if _, err := LoadImportMap(filepath.Join(dir, "broken.json")); err == nil {
+		t.Errorf("expected an error about the mismatched trailing slash")
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	importer := &MemoryImporter{Data: map[string]Contents{
+		"a.libsonnet": MakeContents(`import "b.libsonnet"`),
+		"b.libsonnet": MakeContents(`42`),
+	}}
+	vm := MakeVM()
+	vm.Importer(importer)
+	lockfile := &Lockfile{}
+	vm.Lockfile(lockfile, LockfileRecord)
+	if _, err := vm.EvaluateAnonymousSnippet("main.jsonnet", `import "a.libsonnet"`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"a.libsonnet": contentsHash(importer.Data["a.libsonnet"]),
+		// sha256sum of a file containing "42".
+		"b.libsonnet": "sha256:73475cb40a568e8da8a045ced110137e159f890ac4da883b6b17dc651b3a8049",
+	}
+	if !reflect.DeepEqual(lockfile.Imports, expected) {
+		t.Errorf("Expected %v, but got %v", expected, lockfile.Imports)
+	}
+
+	filename := filepath.Join(t.TempDir(), "jsonnet.lock")
+	if err := lockfile.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLockfile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.BaseDir = ""
+	vm.Lockfile(loaded, LockfileVerify)
+	if _, err := vm.EvaluateAnonymousSnippet("main.jsonnet", `import "a.libsonnet"`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	importer.Data["b.libsonnet"] = MakeContents(`43`)
+	importer.Data["c.libsonnet"] = MakeContents(`44`)
+	vm.Importer(importer)
+	for _, test := range []struct {
+		snippet  string
+		expected string
+	}{
+		{`import "a.libsonnet"`, `contents of "b.libsonnet" do not match the lockfile`},
+		{`import "c.libsonnet"`, `"c.libsonnet" is not in the lockfile`},
+	} {
+		_, err := vm.EvaluateAnonymousSnippet("main.jsonnet", test.snippet)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected an error containing %q, got %v", test.expected, err)
+		}
+	}
+}
+
+func TestLockfileSkipsEntrypoint(t *testing.T) {
+	importer := &MemoryImporter{Data: map[string]Contents{
+		"main.jsonnet": MakeContents(`import "a.libsonnet"`),
+		"a.libsonnet":  MakeContents(`42`),
+	}}
+	vm := MakeVM()
+	vm.Importer(importer)
+	lockfile := &Lockfile{}
+	vm.Lockfile(lockfile, LockfileRecord)
+	if _, err := vm.EvaluateFile("main.jsonnet"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, locked := lockfile.Imports["main.jsonnet"]; locked {
+		t.Errorf("the entrypoint should not be locked: %v", lockfile.Imports)
+	}
+
+	vm.Lockfile(lockfile, LockfileVerify)
+	importer.Data["main.jsonnet"] = MakeContents(`(import "a.libsonnet") + 1`)
+	vm.Importer(importer)
+	if _, err := vm.EvaluateFile("main.jsonnet"); err != nil {
+		t.Fatalf("editing the entrypoint should not fail the verification: %v", err)
+	}
+
+	importer.Data["a.libsonnet"] = MakeContents(`43`)
+	vm.Importer(importer)
+	_, err := vm.EvaluateFile("main.jsonnet")
+	if err == nil || !strings.Contains(err.Error(), `contents of "a.libsonnet" do not match the lockfile`) {
+		t.Fatalf("expected a lockfile mismatch, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "RUNTIME ERROR") {
+		t.Errorf("expected a runtime error, got %v", err)
+	}
+}
+
+func TestFileImporterAllowedRoots(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	files := map[string]string{
+		"root/main.libsonnet":    `import "lib/lib.libsonnet"`,
+		"root/lib/lib.libsonnet": `"lib"`,
+		"secret.txt":             "secret",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "link.txt")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	vm := MakeVM()
+	vm.Importer(&FileImporter{AllowedRoots: []string{root}})
+	evaluate := func(snippet string) (string, error) {
+		program, err := vm.Compile(filepath.Join(root, "main.jsonnet"), snippet)
+		if err != nil {
+			return "", err
+		}
+		return vm.EvaluateProgram(program)
+	}
+	actual, err := evaluate(`import "main.libsonnet"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "\"lib\"\n"; actual != expected {
+		t.Errorf("Expected %q, but got %q", expected, actual)
+	}
+
+	for _, importedPath := range []string{
+		"../secret.txt",
+		filepath.Join(dir, "secret.txt"),
+		"link.txt",
+	} {
+		snippet := fmt.Sprintf("importstr %q", importedPath)
+		_, err := evaluate(snippet)
+		if err == nil || !strings.Contains(err.Error(), "is blocked") || !strings.Contains(err.Error(), "secret.txt") {
+			t.Errorf("%s: expected an error about the blocked path, got %v", snippet, err)
+		}
+	}
+
+	_, err = evaluate(`importstr "missing.txt"`)
+	if err == nil || !strings.Contains(err.Error(), "no match locally") {
+		t.Errorf("expected an error about the missing file, got %v", err)
+	}
+}
+
+type countingFetcher struct {
+	fetcher Fetcher
+	fetched []string
+}
+
+func (fetcher *countingFetcher) Fetch(url string) ([]byte, error) {
+	fetcher.fetched = append(fetcher.fetched, url)
+	return fetcher.fetcher.Fetch(url)
+}
+
+func TestURLImporter(t *testing.T) {
+	files := map[string]string{
+		"/lib/main.libsonnet":      `{ util: import "util/util.libsonnet", data: importstr "../data.txt" }`,
+		"/lib/util/util.libsonnet": `"util"`,
+		"/data.txt":                "data",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	fetcher := &countingFetcher{fetcher: &HTTPFetcher{Client: server.Client()}}
+	vm := MakeVM()
+	vm.Importer(&URLImporter{
+		Importer: &MemoryImporter{Data: map[string]Contents{"local.libsonnet": MakeContents(`"local"`)}},
+		Fetcher:  fetcher,
+		CacheDir: cacheDir,
+	})
+	snippet := fmt.Sprintf(`[import "%s/lib/main.libsonnet", import "local.libsonnet"]`, server.URL)
+	expected := `[ { "data": "data", "util": "util" }, "local" ]`
+	actual, err := vm.EvaluateAnonymousSnippet("main.jsonnet", snippet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+	expectedFetched := []string{
+		server.URL + "/lib/main.libsonnet",
+		server.URL + "/lib/util/util.libsonnet",
+		server.URL + "/data.txt",
+	}
+	sort.Strings(fetcher.fetched)
+	sort.Strings(expectedFetched)
+	if !reflect.DeepEqual(fetcher.fetched, expectedFetched) {
+		t.Errorf("Expected %v, but got %v", expectedFetched, fetcher.fetched)
+	}
+
+	_, err = vm.EvaluateAnonymousSnippet("main.jsonnet", fmt.Sprintf(`import "%s/missing.libsonnet"`, server.URL))
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("expected an error about the missing file, got %v", err)
+	}
+
+	// The server is not needed anymore in offline mode.
+	server.Close()
+	vm.Importer(&URLImporter{
+		Importer: &MemoryImporter{Data: map[string]Contents{"local.libsonnet": MakeContents(`"local"`)}},
+		CacheDir: cacheDir,
+		Offline:  true,
+	})
+	actual, err = vm.EvaluateAnonymousSnippet("main.jsonnet", snippet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+	_, err = vm.EvaluateAnonymousSnippet("main.jsonnet", `import "https://example.com/other.libsonnet"`)
+	if err == nil || !strings.Contains(err.Error(), "not in the cache") {
+		t.Errorf("expected an error about the file missing from the cache, got %v", err)
+	}
+}
+
+func TestURLImporterLockfile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.URL.Path)
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	fetcher := &countingFetcher{fetcher: &HTTPFetcher{Client: server.Client()}}
+	lockfile := &Lockfile{}
+	vm := MakeVM()
+	vm.Importer(&URLImporter{Fetcher: fetcher, CacheDir: cacheDir})
+	vm.Lockfile(lockfile, LockfileRecord)
+	snippet := fmt.Sprintf(`import "%s/a.libsonnet"`, server.URL)
+	if _, err := vm.EvaluateAnonymousSnippet("main.jsonnet", snippet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The pinned file is served from the cache and only the other one is fetched.
+	fetcher.fetched = nil
+	vm = MakeVM()
+	vm.Importer(&URLImporter{Fetcher: fetcher, CacheDir: cacheDir, Lockfile: lockfile})
+	snippet = fmt.Sprintf(`[import "%s/a.libsonnet", import "%s/b.libsonnet"]`, server.URL, server.URL)
+	actual, err := vm.EvaluateAnonymousSnippet("main.jsonnet", snippet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `[ "/a.libsonnet", "/b.libsonnet" ]`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+	expectedFetched := []string{server.URL + "/b.libsonnet"}
+	if !reflect.DeepEqual(fetcher.fetched, expectedFetched) {
+		t.Errorf("Expected %v, but got %v", expectedFetched, fetcher.fetched)
+	}
+}
+
+func TestLockfileURLImporterPaths(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.URL.Path)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "main.jsonnet")
+	files := map[string]string{
+		mainPath: fmt.Sprintf(`[import "lib/a.libsonnet", import "%s/b.libsonnet"]`, server.URL),
+		filepath.Join(dir, "lib", "a.libsonnet"): `"a"`,
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lockfile := &Lockfile{BaseDir: dir}
+	vm := MakeVM()
+	vm.Importer(&URLImporter{
+		Importer: &FileImporter{},
+		Fetcher:  &HTTPFetcher{Client: server.Client()},
+		CacheDir: t.TempDir(),
+	})
+	vm.Lockfile(lockfile, LockfileRecord)
+	if _, err := vm.EvaluateFile(mainPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The local imports are stored relative to BaseDir and the URLs as they are.
+	keys := make([]string, 0, len(lockfile.Imports))
+	for key := range lockfile.Imports {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expected := []string{"lib/a.libsonnet", server.URL + "/b.libsonnet"}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, but got %v", expected, keys)
+	}
+}
+
+func TestInvalidateImport(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	mainPath := write("main.jsonnet", `{ a: import "a.libsonnet", c: import "c.libsonnet" }`)
+	write("a.libsonnet", `import "b.libsonnet"`)
+	bPath := write("b.libsonnet", `"b1"`)
+	write("c.libsonnet", `"c1"`)
+
+	vm := MakeVM()
+	clone := vm.Clone()
+	for _, test := range []struct {
+		vm       *VM
+		expected string
+	}{
+		{vm, `{ "a": "b1", "c": "c1" }`},
+		{clone, `{ "a": "b1", "c": "c1" }`},
+	} {
+		actual, err := test.vm.EvaluateFile(mainPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if removeExcessiveWhitespace(actual) != test.expected {
+			t.Errorf("Expected %q, but got %q", test.expected, removeExcessiveWhitespace(actual))
+		}
+	}
+
+	expectedFiles := []string{filepath.Join(dir, "a.libsonnet"), bPath, filepath.Join(dir, "c.libsonnet"), mainPath}
+	if files := clone.ImportedFiles(); !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Expected %v, but got %v", expectedFiles, files)
+	}
+
+	write("b.libsonnet", `"b2"`)
+	write("c.libsonnet", `"c2"`)
+	vm.InvalidateImport(bPath)
+	// Only b.libsonnet was invalidated, so the cached c.libsonnet is used.
+	for _, test := range []struct {
+		vm       *VM
+		expected string
+	}{
+		{vm, `{ "a": "b2", "c": "c1" }`},
+		{clone, `{ "a": "b2", "c": "c1" }`},
+	} {
+		actual, err := test.vm.EvaluateFile(mainPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if removeExcessiveWhitespace(actual) != test.expected {
+			t.Errorf("Expected %q, but got %q", test.expected, removeExcessiveWhitespace(actual))
+		}
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	vm := MakeVM()
+	snippet := "local base = { a: { x: 1, y: [{ z: 1 }] }, 'b/c': std.manifestJson({ d: 1 }) };\n" +
+		"base + { a+: { x+: 1 } } + { a+: { x+: 2, y: [{ z: 3 }] } }"
+	actual, sourceMap, err := vm.EvaluateAnonymousSnippetSourceMap("test.jsonnet", snippet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{ "a": { "x": 4, "y": [ { "z": 3 } ] }, "b/c": "{\n \"d\": 1\n}" }`
+	if removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+
+	format := func(entry SourceMapEntry) string {
+		s := entry.Definition.String()
+		for _, override := range entry.Overrides {
+			s += " + " + override.String()
+		}
+		return s
+	}
+	actualMap := make(map[string]string)
+	for path, entry := range sourceMap {
+		actualMap[path] = format(entry)
+	}
+	expectedMap := map[string]string{
+		"/a":       "test.jsonnet:1:16-42 + test.jsonnet:2:10-23 + test.jsonnet:2:30-58",
+		"/a/x":     "test.jsonnet:1:21-25 + test.jsonnet:2:16-21 + test.jsonnet:2:36-41",
+		"/a/y":     "test.jsonnet:2:43-56",
+		"/a/y/0/z": "test.jsonnet:2:49-53",
+		"/b~1c":    "test.jsonnet:1:44-77",
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, but got %v", expectedMap, actualMap)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	vm := MakeVM()
+	val, err := vm.EvaluateAnonymousSnippetLazy("explain.jsonnet", `
+		local base = { image: "nginx", replicas:: error "must be overridden" };
+		base + { image+: ":v2", replicas::: 3 } + { image: "other-" + super.image }
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type layer struct {
+		location  string
+		value     interface{}
+		hide      ast.ObjectFieldHide
+		plusSuper bool
+		usesSuper bool
+	}
+	explain := func(name string) []layer {
+		fieldLayers, err := val.Explain(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var layers []layer
+		for _, fieldLayer := range fieldLayers {
+			var value interface{}
+			if fieldLayer.Err != nil {
+				value = "error"
+			} else if value, err = fieldLayer.Value.Manifest(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			layers = append(layers, layer{fieldLayer.Location.String(), value, fieldLayer.Hide, fieldLayer.PlusSuper, fieldLayer.UsesSuper})
+		}
+		return layers
+	}
+
+	expected := []layer{
+		{"explain.jsonnet:2:18-32", "nginx", ast.ObjectFieldInherit, false, false},
+		{"explain.jsonnet:3:12-25", ":v2", ast.ObjectFieldInherit, true, true},
+		{"explain.jsonnet:3:47-70", "other-nginx:v2", ast.ObjectFieldInherit, false, true},
+	}
+	if actual := explain("image"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, but got %v", expected, actual)
+	}
+
+	expected = []layer{
+		{"explain.jsonnet:2:34-71", "error", ast.ObjectFieldHidden, false, false},
+		{"explain.jsonnet:3:27-40", 3.0, ast.ObjectFieldVisible, false, false},
+	}
+	if actual := explain("replicas"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, but got %v", expected, actual)
+	}
+
+	_, err = val.Explain("missing")
+	if err == nil || !strings.Contains(err.Error(), "Field does not exist: missing") {
+		t.Errorf("Expected a missing field error, but got %v", err)
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	vm := MakeVM()
+	profiler := NewProfiler()
+	vm.Profile(profiler)
+	_, err := vm.EvaluateAnonymousSnippet("profile.jsonnet", `
+		local f(n) = if n == 0 then 0 else 1 + f(n - 1);
+		local g = [function(x) x + 1, function(x) x * 2];
+		{ a: f(10), b: g[0](1), c: g[1](2) }
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	functionName := func(locationID uint64) string {
+		return profiler.functionList[profiler.locationList[locationID-1].function-1].name
+	}
+	maxDepth := 0
+	for _, sample := range profiler.sampleList {
+		depth := 0
+		for _, id := range sample.stack {
+			if functionName(id) == "function <f>:2:9" {
+				depth++
+			}
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	// The innermost call of f is called from 10 others.
+	if maxDepth != 11 {
+		t.Errorf("Expected 11 nested calls of f, but got %d", maxDepth)
+	}
+
+	samples := len(profiler.sampleList)
+	vm.Profile(nil)
+	if _, err := vm.EvaluateAnonymousSnippet("other.jsonnet", `{ b: 1 }`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(profiler.sampleList) != samples {
+		t.Errorf("Expected no new samples after the profiling was stopped")
+	}
+}
+
+func TestProfilerPprof(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not available")
+	}
+	vm := MakeVM()
+	profiler := NewProfiler()
+	vm.Profile(profiler)
+	_, err = vm.EvaluateAnonymousSnippet("profile.jsonnet", `
+		local f(n) = if n == 0 then 0 else 1 + f(n - 1);
+		local g = [function(x) x + 1, function(x) x * 2];
+		{ a: f(10), b: g[0](1), c: g[1](2) }
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	profileFile := filepath.Join(t.TempDir(), "profile.pb.gz")
+	f, err := os.Create(profileFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = profiler.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	output, err := exec.Command(goTool, "tool", "pprof", "-top", "-sample_index=nodes", profileFile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool pprof failed: %v\n%s", err, output)
+	}
+	// Each anonymous function is a separate function in the profile.
+	for _, function := range []string{"function <f>:2:9", "function <anonymous>:3:14", "function <anonymous>:3:33", "object <anonymous>:4:3"} {
+		if !bytes.Contains(output, []byte(" "+function+"\n")) {
+			t.Errorf("Expected %q in the profile:\n%s", function, output)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	vm := MakeVM()
+	coverage := NewCoverage()
+	vm.Coverage(coverage)
+	_, err := vm.EvaluateAnonymousSnippet("coverage.jsonnet", `local lib = {
+  used: 1,
+  unused: 2,
+  f(x)::
+    if x > 0 then
+      'positive'
+    else
+      'other',
+};
+{ a: lib.used, b: lib.f(1) }
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var lcov bytes.Buffer
+	if err := coverage.WriteLCOV(&lcov); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "SF:coverage.jsonnet\n" +
+		"BRDA:2,2,2,1\nBRDA:3,2,3,0\nBRDA:4,2,4,1\nBRDA:5,5,5,1\nBRDA:5,5,6,0\nBRDA:10,0,0,1\nBRDA:10,0,1,1\n" +
+		"BRF:7\nBRH:5\n" +
+		"DA:1,1\nDA:2,1\nDA:3,0\nDA:5,1\nDA:6,1\nDA:8,0\nDA:10,1\n" +
+		"LF:7\nLH:5\n" +
+		"end_of_record\n"
+	if lcov.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, lcov.String())
+	}
+
+	var goCover bytes.Buffer
+	if err := coverage.WriteGoCover(&goCover); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = "mode: count\n" +
+		"coverage.jsonnet:1.1,1.14 1 1\n" +
+		"coverage.jsonnet:2.1,2.11 1 1\n" +
+		"coverage.jsonnet:3.1,3.13 1 0\n" +
+		"coverage.jsonnet:5.1,5.18 1 1\n" +
+		"coverage.jsonnet:6.1,6.17 1 1\n" +
+		"coverage.jsonnet:8.1,8.15 1 0\n" +
+		"coverage.jsonnet:10.1,10.29 1 1\n"
+	if goCover.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, goCover.String())
+	}
+}
+
+type testEvalHandler struct {
+	before func(event *EvalEvent) error
+	after  func(event *EvalEvent) error
+}
+
+func (h *testEvalHandler) BeforeEval(event *EvalEvent) error {
+	if h.before == nil {
+		return nil
+	}
+	return h.before(event)
+}
+
+func (h *testEvalHandler) AfterEval(event *EvalEvent) error {
+	if h.after == nil {
+		return nil
+	}
+	return h.after(event)
+}
+
+func TestEvalHandler(t *testing.T) {
+	vm := MakeVM()
+	var sums []interface{}
+	var traces []string
+	tracer := &testEvalHandler{
+		after: func(event *EvalEvent) error {
+			if _, ok := event.Node.(*ast.Binary); !ok || event.Err != nil {
+				return nil
+			}
+			sum, err := event.Value().Manifest()
+			if err != nil {
+				return err
+			}
+			sums = append(sums, sum)
+			var names []string
+			for _, frame := range event.StackTrace() {
+				if frame.Name != "" {
+					names = append(names, frame.Name)
+				}
+			}
+			traces = append(traces, strings.Join(names, " / "))
+			return nil
+		},
+	}
+	vm.AddEvalHandler(tracer)
+	actual, err := vm.EvaluateAnonymousSnippet("handler.jsonnet", `
+		local f(x) = x + 1;
+		{ a: f(1) }
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := `{ "a": 2 }`; removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+	if expected := []interface{}{2.0}; !reflect.DeepEqual(sums, expected) {
+		t.Errorf("Expected %v, but got %v", expected, sums)
+	}
+	if expected := []string{"object <anonymous> / function <f>"}; !reflect.DeepEqual(traces, expected) {
+		t.Errorf("Expected %v, but got %v", expected, traces)
+	}
+
+	errNoImports := errors.New("imports are not allowed")
+	policy := &testEvalHandler{
+		before: func(event *EvalEvent) error {
+			if _, ok := event.Node.(*ast.Import); ok {
+				return errNoImports
+			}
+			return nil
+		},
+	}
+	// The nodes rejected by the policy are not passed to the next handler.
+	depth := 0
+	counter := &testEvalHandler{
+		before: func(event *EvalEvent) error {
+			depth++
+			return nil
+		},
+		after: func(event *EvalEvent) error {
+			depth--
+			return nil
+		},
+	}
+	vm.AddEvalHandler(policy)
+	vm.AddEvalHandler(counter)
+	_, err = vm.EvaluateAnonymousSnippet("handler.jsonnet", `{ a: import "lib.jsonnet" }`)
+	if !errors.Is(err, errNoImports) {
+		t.Errorf("Expected %v, but got %v", errNoImports, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "handler.jsonnet:1:6-26") {
+		t.Errorf("Expected the location of the import in %v", err)
+	}
+	if depth != 0 {
+		t.Errorf("Expected matching BeforeEval and AfterEval calls, but got a difference of %d", depth)
+	}
+
+	vm.RemoveEvalHandler(policy)
+	vm.RemoveEvalHandler(counter)
+
+	// A failed access to a value does not break the evaluation.
+	inspector := &testEvalHandler{
+		after: func(event *EvalEvent) error {
+			if _, ok := event.Node.(*ast.DesugaredObject); ok && event.Err == nil {
+				if _, err := event.Value().Field("bad"); err == nil {
+					t.Errorf("Expected an error from the bad field")
+				}
+			}
+			return nil
+		},
+	}
+	vm.AddEvalHandler(inspector)
+	actual, err = vm.EvaluateAnonymousSnippet("handler.jsonnet", `
+		local f(x) = { bad:: error "boom", a: x };
+		[f(1), f(2)]
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := `[ { "a": 1 }, { "a": 2 } ]`; removeExcessiveWhitespace(actual) != expected {
+		t.Errorf("Expected %q, but got %q", expected, removeExcessiveWhitespace(actual))
+	}
+	vm.RemoveEvalHandler(inspector)
+	vm.RemoveEvalHandler(tracer)
+	sums = nil
+	if _, err = vm.EvaluateAnonymousSnippet("handler.jsonnet", `{ a: 1 + 1 }`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sums) != 0 {
+		t.Errorf("Expected no calls after the handler was removed, but got %v", sums)
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+
+	"github.com/google/go-jsonnet/ast"
+)
+
+// Value is a handle to a Jsonnet value which can be inspected from Go.
+//
+// The value is evaluated when it is first accessed and its contents (object
+// fields, array elements) are only evaluated when they are accessed. This
+// allows to extract a small part of a big configuration without manifesting
+// the whole thing.
+//
+// Values obtained from one evaluation share the state of the interpreter,
+// so they must not be used concurrently.
+type Value struct {
+	// Used for formatting errors. It is nil for the arguments of native
+	// functions, whose errors are passed back to the interpreter.
+	vm *VM
+	i  *interpreter
+	th *cachedThunk
+	// nested is true for the values accessed while the interpreter is
+	// evaluating, e.g. the arguments of native functions. The evaluation
+	// takes care of their panics.
+	nested bool
+}
+
+func hostAccessTrace() traceElement {
+	loc := ast.MakeLocationRangeMessage("During host access")
+	return traceElement{
+		loc: &loc,
+	}
+}
+
+// do evaluates the value and runs f on the result, with the interpreter
+// prepared for evaluation from the outside. The call stack and trace are
+// restored afterwards, also if the evaluation failed, which leaves them as
+// they were at the error. This keeps the interpreter usable for the
+// evaluation which is in progress, if any, and for other accesses.
+func (v *Value) do(f func(val value) error) (err error) {
+	stackSize, calls, trace := len(v.i.stack.stack), v.i.stack.calls, v.i.stack.currentTrace
+	defer func() {
+		v.i.stack.stack = v.i.stack.stack[:stackSize]
+		v.i.stack.calls = calls
+		v.i.stack.currentTrace = trace
+	}()
+	if !v.nested {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
+			}
+		}()
+	}
+	if trace == (traceElement{}) {
+		// Native functions already have the trace of their call site.
+		v.i.stack.setCurrentTrace(hostAccessTrace())
+	}
+	err = v.doAux(f)
+	if err != nil && v.vm != nil {
+		return v.vm.formatError(err)
+	}
+	return err
+}
+
+func (v *Value) doAux(f func(val value) error) error {
+	val, err := v.th.getValue(v.i)
+	if err != nil {
+		return err
+	}
+	return f(val)
+}
+
+func (v *Value) wrap(val value) *Value {
+	return &Value{vm: v.vm, i: v.i, th: readyThunk(val), nested: v.nested}
+}
+
+// Type returns the type of the value, using the same names as std.type,
+// i.e. one of "null", "boolean", "number", "string", "array", "object"
+// and "function".
+func (v *Value) Type() (t string, err error) {
+	err = v.do(func(val value) error {
+		t = val.getType().name
+		return nil
+	})
+	return
+}
+
+// IsNull returns true if the value is null.
+func (v *Value) IsNull() (null bool, err error) {
+	err = v.do(func(val value) error {
+		null = val.getType() == nullType
+		return nil
+	})
+	return
+}
+
+// AsBool returns the value of a boolean.
+func (v *Value) AsBool() (b bool, err error) {
+	err = v.do(func(val value) error {
+		boolean, err := v.i.getBoolean(val)
+		if err != nil {
+			return err
+		}
+		b = boolean.value
+		return nil
+	})
+	return
+}
+
+// AsNumber returns the value of a number.
+func (v *Value) AsNumber() (n float64, err error) {
+	err = v.do(func(val value) error {
+		num, err := v.i.getNumber(val)
+		if err != nil {
+			return err
+		}
+		n = num.value
+		return nil
+	})
+	return
+}
+
+// AsString returns the value of a string.
+func (v *Value) AsString() (s string, err error) {
+	err = v.do(func(val value) error {
+		str, err := v.i.getString(val)
+		if err != nil {
+			return err
+		}
+		s = str.getGoString()
+		return nil
+	})
+	return
+}
+
+// Len returns the number of elements of an array, the number of characters
+// of a string or the number of visible fields of an object, like std.length.
+func (v *Value) Len() (n int, err error) {
+	err = v.do(func(val value) error {
+		switch val := val.(type) {
+		case *valueArray:
+			n = val.length()
+		case valueString:
+			n = val.length()
+		case *valueObject:
+			n = len(objectFields(val, withoutHidden))
+		default:
+			return v.i.Error(fmt.Sprintf("length operates on strings, objects, and arrays, got %v", val.getType().name))
+		}
+		return nil
+	})
+	return
+}
+
+// Index returns the element of an array at the given position. Only that
+// element is evaluated.
+func (v *Value) Index(index int) (elem *Value, err error) {
+	err = v.do(func(val value) error {
+		arr, err := v.i.getArray(val)
+		if err != nil {
+			return err
+		}
+		item, err := arr.index(v.i, index)
+		if err != nil {
+			return err
+		}
+		elem = v.wrap(item)
+		return nil
+	})
+	return
+}
+
+// Fields returns the sorted names of the visible fields of an object,
+// like std.objectFields.
+func (v *Value) Fields() ([]string, error) {
+	return v.fields(withoutHidden)
+}
+
+// FieldsAll returns the sorted names of all fields of an object, including
+// the hidden ones, like std.objectFieldsAll.
+func (v *Value) FieldsAll() ([]string, error) {
+	return v.fields(withHidden)
+}
+
+func (v *Value) fields(h hidden) (fields []string, err error) {
+	err = v.do(func(val value) error {
+		obj, err := v.i.getObject(val)
+		if err != nil {
+			return err
+		}
+		fields = objectFields(obj, h)
+		sort.Strings(fields)
+		return nil
+	})
+	return
+}
+
+// Field returns the value of an object field, which may be hidden.
+// Only that field is evaluated (and the object assertions are checked).
+func (v *Value) Field(name string) (field *Value, err error) {
+	err = v.do(func(val value) error {
+		obj, err := v.i.getObject(val)
+		if err != nil {
+			return err
+		}
+		fieldVal, err := obj.index(v.i, name)
+		if err != nil {
+			return err
+		}
+		field = v.wrap(fieldVal)
+		return nil
+	})
+	return
+}
+
+// Call calls a function with the given positional arguments. An argument
+// may be a *Value from the same evaluation or a Go value supported by
+// VM.ExtValue.
+func (v *Value) Call(arguments ...interface{}) (result *Value, err error) {
+	err = v.do(func(val value) error {
+		f, err := v.i.getFunction(val)
+		if err != nil {
+			return err
+		}
+		var callArgs callArguments
+		for _, arg := range arguments {
+			th, err := v.argToThunk(arg)
+			if err != nil {
+				return err
+			}
+			callArgs.positional = append(callArgs.positional, th)
+		}
+		resultVal, err := f.call(v.i, callArgs)
+		if err != nil {
+			return err
+		}
+		result = v.wrap(resultVal)
+		return nil
+	})
+	return
+}
+
+func (v *Value) argToThunk(arg interface{}) (*cachedThunk, error) {
+	if val, ok := arg.(*Value); ok {
+		if val.i != v.i {
+			return nil, v.i.Error("Cannot pass a Value from a different evaluation")
+		}
+		return val.th, nil
+	}
+	val, err := goToValue(v.i, arg)
+	if err != nil {
+		return nil, err
+	}
+	return readyThunk(val), nil
+}
+
+// Manifest evaluates the value fully and returns it in the standard Go
+// representation of JSON (as in "encoding/json" package).
+func (v *Value) Manifest() (result interface{}, err error) {
+	err = v.do(func(val value) error {
+		manifested, err := v.i.manifestOutput(val)
+		if err != nil {
+			return err
+		}
+		result = manifested
+		return nil
+	})
+	return
+}
+
+// Decode evaluates the value fully and stores it in the Go value pointed to
+// by target, following the rules of json.Unmarshal.
+func (v *Value) Decode(target interface{}) error {
+	result, err := v.Manifest()
+	if err != nil {
+		return err
+	}
+	return decodeInto(result, target)
+}
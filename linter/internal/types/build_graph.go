@@ -107,6 +107,56 @@ func countRequiredParameters(params []ast.Parameter) int {
 	return count
 }
 
+// nativeSignature checks if the node is std.native("name") with a known native
+// function and returns its signature.
+func (g *typeGraph) nativeSignature(node *ast.Apply) (NativeSignature, bool) {
+	index, ok := node.Target.(*ast.Index)
+	if !ok || len(node.Arguments.Positional) != 1 || len(node.Arguments.Named) != 0 {
+		return NativeSignature{}, false
+	}
+	if v, ok := index.Target.(*ast.Var); !ok || (v.Id != "std" && v.Id != "$std") {
+		return NativeSignature{}, false
+	}
+	if fieldName, ok := index.Index.(*ast.LiteralString); !ok || fieldName.Value != "native" {
+		return NativeSignature{}, false
+	}
+	name, ok := node.Arguments.Positional[0].Expr.(*ast.LiteralString)
+	if !ok {
+		return NativeSignature{}, false
+	}
+	sig, found := g.natives[name.Value]
+	return sig, found
+}
+
+func nativeFunctionDesc(sig NativeSignature) *functionDesc {
+	if sig.Variadic {
+		// Only the number of arguments is checked.
+		required := 0
+		for _, param := range sig.Params[:len(sig.Params)-1] {
+			if param.DefaultArg == nil {
+				required++
+			}
+		}
+		return &functionDesc{
+			minArity:       required,
+			maxArity:       maxPossibleArity,
+			resultContains: []placeholderID{anyType},
+		}
+	}
+	required := 0
+	for _, param := range sig.Params {
+		if param.DefaultArg == nil {
+			required++
+		}
+	}
+	return &functionDesc{
+		minArity:       required,
+		maxArity:       len(sig.Params),
+		params:         sig.Params,
+		resultContains: []placeholderID{anyType},
+	}
+}
+
 // calcTP calculates a definition for a type placeholder.
 func calcTP(node ast.Node, varAt map[ast.Node]*common.Variable, g *typeGraph) typePlaceholder {
 	switch node := node.(type) {
@@ -247,6 +297,9 @@ func calcTP(node ast.Node, varAt map[ast.Node]*common.Variable, g *typeGraph) ty
 			resultContains: []placeholderID{g.getExprPlaceholder(node.Body)},
 		}})
 	case *ast.Apply:
+		if sig, isNative := g.nativeSignature(node); isNative {
+			return concreteTP(TypeDesc{FunctionDesc: nativeFunctionDesc(sig)})
+		}
 		return tpIndex(functionCallIndex(g.getExprPlaceholder(node.Target)))
 	}
 	panic(fmt.Sprintf("Unexpected %#v", node))
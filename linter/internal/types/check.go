@@ -132,9 +132,11 @@ func checkArgs(params []ast.Parameter, args *ast.Arguments, loc *ast.LocationRan
 // * root nodes of all (transitively) imported Jsonnet files
 // * resolution of variables in all files
 // * importFunc which allows resolving imports
-func Check(mainNode ast.Node, roots map[string]ast.Node, vars map[string]map[ast.Node]*common.Variable, importFunc ImportFunc, ec *common.ErrCollector) {
+// * signatures of the native functions available through std.native
+func Check(mainNode ast.Node, roots map[string]ast.Node, vars map[string]map[ast.Node]*common.Variable, importFunc ImportFunc, natives map[string]NativeSignature, ec *common.ErrCollector) {
 	et := make(exprTypes)
 	g := newTypeGraph(importFunc)
+	g.natives = natives
 	g.addRoots(roots, vars)
 	g.prepareTypes(mainNode, et)
 
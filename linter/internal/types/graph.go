@@ -20,6 +20,17 @@ type typeGraph struct {
 
 	// TODO(sbarzowski) what was this for?
 	importFunc ImportFunc
+
+	// Signatures of the native functions
+	natives map[string]NativeSignature
+}
+
+// NativeSignature describes the parameters of a native function.
+type NativeSignature struct {
+	// The optional parameters have a non-nil DefaultArg.
+	Params []ast.Parameter
+	// Whether the last parameter takes all the remaining positional arguments.
+	Variadic bool
 }
 
 func (g *typeGraph) placeholder(id placeholderID) *typePlaceholder {
@@ -43,6 +43,14 @@ type nodeWithLocation struct {
 	path string
 }
 
+func nativeSignatures(vm *jsonnet.VM) map[string]types.NativeSignature {
+	result := make(map[string]types.NativeSignature)
+	for name, sig := range vm.NativeSignatures() {
+		result[name] = types.NativeSignature{Params: sig.Params, Variadic: sig.Variadic}
+	}
+	return result
+}
+
 // Lint analyses a node and reports any issues it encounters to an error writer.
 func lint(vm *jsonnet.VM, nodes []nodeWithLocation, errWriter *ErrorWriter) {
 	roots := make(map[string]ast.Node)
@@ -90,7 +98,7 @@ func lint(vm *jsonnet.VM, nodes []nodeWithLocation, errWriter *ErrorWriter) {
 				return nil
 			}
 			return node
-		}, &ec)
+		}, nativeSignatures(vm), &ec)
 
 		traversal.Traverse(node.node, &ec)
 
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	jsonnet "github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
 	"github.com/google/go-jsonnet/internal/testutils"
 )
 
@@ -161,3 +162,46 @@ func TestLinter(t *testing.T) {
 		runTests(t, tests)
 	})
 }
+
+func TestNativeSignatures(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:     "greet",
+		Params:   ast.Identifiers{"name", "greeting"},
+		Defaults: map[ast.Identifier]interface{}{"greeting": "Hello"},
+		Func: func(args []interface{}) (interface{}, error) {
+			return nil, nil
+		},
+	})
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:     "concat",
+		Params:   ast.Identifiers{"first", "rest"},
+		Variadic: true,
+		Func: func(args []interface{}) (interface{}, error) {
+			return nil, nil
+		},
+	})
+
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{`std.native("greet")("a")`, ""},
+		{`std.native("greet")(name="a", greeting="b")`, ""},
+		{`std.native("greet")()`, "Missing argument: name"},
+		{`std.native("greet")("a", foo="b")`, "function has no parameter foo"},
+		{`std.native("concat")(1, 2, 3, 4)`, ""},
+		{`std.native("concat")()`, "Too few arguments: got 0, but expected at least 1"},
+		{`std.native("unknown")(1, 2, 3)`, ""},
+	}
+	for _, test := range tests {
+		var out strings.Builder
+		LintSnippet(vm, &out, []Snippet{{FileName: "native.jsonnet", Code: test.code}})
+		if test.expected == "" && out.Len() != 0 {
+			t.Errorf("%s: expected no problems, got:\n%s", test.code, out.String())
+		}
+		if !strings.Contains(out.String(), test.expected) {
+			t.Errorf("%s: expected %q, got:\n%s", test.code, test.expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Lockfile holds the hashes of imported files, so that an evaluation can be
+// checked against the exact versions of the libraries it was tested with.
+type Lockfile struct {
+	// Imports maps the paths of the imported files (foundAt) to the hashes
+	// of their contents, e.g. "sha256:2c26b46b68ffc68ff99b453c1d304134...".
+	Imports map[string]string `json:"imports"`
+	// BaseDir is the directory the paths of files imported by FileImporter
+	// are relative to, usually the directory of the lockfile. If it is empty,
+	// foundAt is used unchanged.
+	BaseDir string `json:"-"`
+}
+
+// LockfileMode tells the VM what to do with a Lockfile.
+type LockfileMode int
+
+const (
+	// LockfileRecord adds the hashes of all imported files to the lockfile.
+	LockfileRecord LockfileMode = iota
+	// LockfileVerify rejects imported files which are not in the lockfile
+	// or whose hashes differ.
+	LockfileVerify
+)
+
+// LoadLockfile reads a lockfile written by Lockfile.Save. Its BaseDir is
+// the directory of the file.
+func LoadLockfile(filename string) (*Lockfile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	lockfile := &Lockfile{}
+	if err := json.Unmarshal(data, lockfile); err != nil {
+		return nil, fmt.Errorf("lockfile %#v: %v", filename, err)
+	}
+	if lockfile.Imports == nil {
+		lockfile.Imports = make(map[string]string)
+	}
+	lockfile.BaseDir = filepath.Dir(filename)
+	return lockfile, nil
+}
+
+// Save writes the lockfile as JSON.
+func (lockfile *Lockfile) Save(filename string) error {
+	data, err := json.MarshalIndent(lockfile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+func contentsHash(contents Contents) string {
+	return "sha256:" + sha256Hex(contents.Data())
+}
+
+// importLock is a Lockfile used by an importCache.
+type importLock struct {
+	lockfile *Lockfile
+	mode     LockfileMode
+}
+
+// key returns the path under which foundAt is stored in the lockfile.
+func (lock *importLock) key(importer Importer, foundAt string) (string, error) {
+	if lock.lockfile.BaseDir == "" || !usesFilesystemPaths(importer, foundAt) {
+		return foundAt, nil
+	}
+	absPath, err := getAbsPath(foundAt)
+	if err != nil {
+		return "", err
+	}
+	baseDir, err := getAbsPath(lock.lockfile.BaseDir)
+	if err != nil {
+		return "", err
+	}
+	relPath, err := filepath.Rel(baseDir, absPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relPath), nil
+}
+
+// check records or verifies the hash of a newly imported file.
+func (lock *importLock) check(importer Importer, importedPath, foundAt string, contents Contents) error {
+	key, err := lock.key(importer, foundAt)
+	if err != nil {
+		return err
+	}
+	hash := contentsHash(contents)
+	if lock.mode == LockfileRecord {
+		if lock.lockfile.Imports == nil {
+			lock.lockfile.Imports = make(map[string]string)
+		}
+		lock.lockfile.Imports[key] = hash
+		return nil
+	}
+	expected, locked := lock.lockfile.Imports[key]
+	if !locked {
+		return fmt.Errorf("import %#v: %#v is not in the lockfile", importedPath, key)
+	}
+	if expected != hash {
+		return fmt.Errorf("import %#v: contents of %#v do not match the lockfile (expected %s, got %s)", importedPath, key, expected, hash)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/go-jsonnet/ast"
+)
+
+var valueHandleType = reflect.TypeOf((*Value)(nil))
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// MakeNativeFunction creates a native function from an ordinary Go function,
+// e.g. func(name string, n int, opts Options) (Result, error).
+//
+// The arguments are converted to the types of the parameters following
+// the rules of json.Unmarshal. A parameter of type *Value receives the
+// argument without evaluating it. A variadic Go function makes a variadic
+// native function. The function must return a single value or a value and
+// an error. The result is converted like in VM.ExtValue.
+//
+// The params are the names of the parameters visible from Jsonnet. Go does
+// not keep them, so they are x0, x1, ... if none are provided.
+func MakeNativeFunction(name string, f interface{}, params ...ast.Identifier) (*LazyNativeFunction, error) {
+	fv := reflect.ValueOf(f)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return nil, fmt.Errorf("native function %#v: expected a function, got %T", name, f)
+	}
+	ft := fv.Type()
+	switch {
+	case ft.NumOut() == 1 && ft.Out(0) != errorType:
+	case ft.NumOut() == 2 && ft.Out(1) == errorType:
+	default:
+		return nil, fmt.Errorf("native function %#v: expected a function returning a value or a value and an error, got %v", name, ft)
+	}
+	if len(params) == 0 {
+		for index := 0; index < ft.NumIn(); index++ {
+			params = append(params, ast.Identifier(fmt.Sprintf("x%d", index)))
+		}
+	}
+	if len(params) != ft.NumIn() {
+		return nil, fmt.Errorf("native function %#v: got %d parameter names for a function with %d parameters", name, len(params), ft.NumIn())
+	}
+
+	call := func(args []*Value) (interface{}, error) {
+		in := make([]reflect.Value, len(args))
+		for index, arg := range args {
+			paramType := ft.In(index)
+			if paramType == valueHandleType {
+				in[index] = reflect.ValueOf(arg)
+				continue
+			}
+			manifested, err := arg.Manifest()
+			if err != nil {
+				return nil, err
+			}
+			param := reflect.New(paramType)
+			if err := decodeInto(manifested, param.Interface()); err != nil {
+				return nil, fmt.Errorf("native function %#v, parameter %v: %v", name, params[index], err)
+			}
+			in[index] = param.Elem()
+		}
+		var out []reflect.Value
+		if ft.IsVariadic() {
+			out = fv.CallSlice(in)
+		} else {
+			out = fv.Call(in)
+		}
+		if len(out) == 2 && !out[1].IsNil() {
+			return nil, out[1].Interface().(error)
+		}
+		return out[0].Interface(), nil
+	}
+
+	return &LazyNativeFunction{
+		Name:     name,
+		Func:     call,
+		Params:   params,
+		Variadic: ft.IsVariadic(),
+	}, nil
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/go-jsonnet/ast"
+)
+
+// Profiler is an EvalHandler which measures the cost of the evaluated
+// Jsonnet code, see VM.Profile. It counts the evaluated AST nodes and the
+// time spent in them per call stack, in which the frames are the Jsonnet
+// functions (and other contexts, like object fields) and the call sites in
+// them. The functions are named with the position of their definition,
+// e.g. "function <anonymous>:3:14", so that they are not merged by name.
+//
+// The profile can be written in the pprof format, so it can be analyzed
+// with `go tool pprof`, e.g. with -top, -files or -http.
+//
+// A Profiler must not be used by multiple evaluations at the same time.
+type Profiler struct {
+	start time.Time
+
+	functions    map[profileFunction]uint64
+	functionList []profileFunction
+	// definitions holds the locations where the functions, objects and
+	// thunks (identified by the contexts of their bodies) are defined, so
+	// that e.g. the anonymous functions are told apart.
+	definitions  map[*string]ast.Location
+	locations    map[profileLocation]uint64
+	locationList []profileLocation
+	samples      map[string]*profileSample
+	sampleList   []*profileSample
+
+	// The state of the current evaluation.
+	interpreter *interpreter
+	last        time.Time
+	// active holds the samples of the nodes being evaluated, the innermost
+	// one last. The time is charged to the innermost one.
+	active []*profileSample
+	// callers is the stack of the call sites for the top of the call stack
+	// callersTop, which is at position callersLen.
+	callers    []uint64
+	callersTop *callFrame
+	callersLen int
+}
+
+type profileFunction struct {
+	name       string
+	file       string
+	definition ast.Location
+}
+
+type profileLocation struct {
+	function uint64
+	line     int
+	column   int
+}
+
+type profileSample struct {
+	// stack holds the location IDs, starting with the innermost one.
+	stack       []uint64
+	nodes       int64
+	nanoseconds int64
+}
+
+// NewProfiler creates an empty profile.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		start:       time.Now(),
+		functions:   make(map[profileFunction]uint64),
+		definitions: make(map[*string]ast.Location),
+		locations:   make(map[profileLocation]uint64),
+		samples:     make(map[string]*profileSample),
+	}
+}
+
+func (p *Profiler) location(loc *ast.LocationRange, context ast.Context) uint64 {
+	function := profileFunction{name: "<unknown>", file: diagnosticFileName(loc)}
+	if context != nil {
+		definition, ok := p.definitions[context]
+		if !ok {
+			// The first node evaluated in a thunk is its body.
+			definition = loc.Begin
+			p.definitions[context] = definition
+		}
+		function.name = fmt.Sprintf("%s:%d:%d", *context, definition.Line, definition.Column)
+		function.definition = definition
+	} else if !loc.IsSet() {
+		// A pseudo-location with a message, e.g. "During manifestation".
+		function = profileFunction{name: loc.FileName}
+	}
+	functionID, ok := p.functions[function]
+	if !ok {
+		p.functionList = append(p.functionList, function)
+		functionID = uint64(len(p.functionList))
+		p.functions[function] = functionID
+	}
+	location := profileLocation{function: functionID, line: loc.Begin.Line, column: loc.Begin.Column}
+	locationID, ok := p.locations[location]
+	if !ok {
+		p.locationList = append(p.locationList, location)
+		locationID = uint64(len(p.locationList))
+		p.locations[location] = locationID
+	}
+	return locationID
+}
+
+// sample returns the sample for evaluating node in the current call stack.
+func (p *Profiler) sample(i *interpreter, node ast.Node) *profileSample {
+	frames := i.stack.stack
+	if len(frames) != p.callersLen || (len(frames) > 0 && frames[len(frames)-1] != p.callersTop) {
+		p.callers = p.callers[:0]
+		for index := len(frames) - 1; index >= 0; index-- {
+			if frames[index].cleanEnv && frames[index].trace.loc != nil {
+				p.callers = append(p.callers, p.location(frames[index].trace.loc, frames[index].trace.context))
+			}
+		}
+		p.callersLen = len(frames)
+		p.callersTop = nil
+		if len(frames) > 0 {
+			p.callersTop = frames[len(frames)-1]
+		}
+	}
+
+	leaf := p.location(node.Loc(), node.Context())
+	key := binary.AppendUvarint(nil, leaf)
+	for _, id := range p.callers {
+		key = binary.AppendUvarint(key, id)
+	}
+	sample, ok := p.samples[string(key)]
+	if !ok {
+		stack := make([]uint64, 0, len(p.callers)+1)
+		stack = append(append(stack, leaf), p.callers...)
+		sample = &profileSample{stack: stack}
+		p.samples[string(key)] = sample
+		p.sampleList = append(p.sampleList, sample)
+	}
+	return sample
+}
+
+// charge adds the time since the last event to the innermost active node.
+func (p *Profiler) charge(now time.Time) {
+	if len(p.active) > 0 {
+		p.active[len(p.active)-1].nanoseconds += int64(now.Sub(p.last))
+	}
+	p.last = now
+}
+
+// define records the definitions of the functions and objects created
+// by the node, before their bodies are evaluated.
+func (p *Profiler) define(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.Function:
+		p.defineContext(node.Body.Context(), node)
+	case *ast.DesugaredObject:
+		for _, field := range node.Fields {
+			p.defineContext(field.Body.Context(), node)
+		}
+	}
+}
+
+func (p *Profiler) defineContext(context *string, node ast.Node) {
+	if _, ok := p.definitions[context]; context != nil && !ok {
+		p.definitions[context] = node.Loc().Begin
+	}
+}
+
+// BeforeEval starts charging the time to the node.
+func (p *Profiler) BeforeEval(event *EvalEvent) error {
+	i, node := event.i, event.Node
+	now := time.Now()
+	if i != p.interpreter {
+		// A new evaluation, the previous one might have been aborted.
+		p.interpreter = i
+		p.active = p.active[:0]
+		p.callersLen, p.callersTop = -1, nil
+	}
+	p.charge(now)
+	p.define(node)
+	sample := p.sample(i, node)
+	sample.nodes++
+	p.active = append(p.active, sample)
+	return nil
+}
+
+// AfterEval goes back to charging the time to the parent of the node.
+func (p *Profiler) AfterEval(event *EvalEvent) error {
+	p.charge(time.Now())
+	if len(p.active) > 0 {
+		p.active = p.active[:len(p.active)-1]
+	}
+	return nil
+}
+
+// Profile makes the VM record the evaluations in the profiler, replacing
+// the profiler set before. A nil profiler stops the profiling. The profiler
+// is added as an EvalHandler, see VM.AddEvalHandler.
+func (vm *VM) Profile(p *Profiler) {
+	for _, handler := range vm.EvalHook.handlers {
+		if old, ok := handler.(*Profiler); ok {
+			vm.RemoveEvalHandler(old)
+		}
+	}
+	if p != nil {
+		vm.AddEvalHandler(p)
+	}
+}
+
+// protoBuffer encodes the protocol buffers of the pprof format.
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	protoVarint          = 0
+	protoLengthDelimited = 2
+)
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.data = binary.AppendUvarint(b.data, uint64(field<<3|wireType))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x != 0 {
+		b.tag(field, protoVarint)
+		b.data = binary.AppendUvarint(b.data, x)
+	}
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.tag(field, protoLengthDelimited)
+	b.data = binary.AppendUvarint(b.data, uint64(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var packed []byte
+	for _, x := range xs {
+		packed = binary.AppendUvarint(packed, x)
+	}
+	b.tag(field, protoLengthDelimited)
+	b.data = binary.AppendUvarint(b.data, uint64(len(packed)))
+	b.data = append(b.data, packed...)
+}
+
+func (b *protoBuffer) message(field int, encode func(b *protoBuffer)) {
+	var message protoBuffer
+	encode(&message)
+	b.tag(field, protoLengthDelimited)
+	b.data = binary.AppendUvarint(b.data, uint64(len(message.data)))
+	b.data = append(b.data, message.data...)
+}
+
+// Field numbers of profile.proto of pprof.
+const (
+	pprofSampleType        = 1
+	pprofSample            = 2
+	pprofLocation          = 4
+	pprofFunction          = 5
+	pprofStringTable       = 6
+	pprofTimeNanos         = 9
+	pprofDurationNanos     = 10
+	pprofPeriodType        = 11
+	pprofPeriod            = 12
+	pprofDefaultSampleType = 14
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+
+	pprofLocationID   = 1
+	pprofLocationLine = 4
+
+	pprofLineFunctionID = 1
+	pprofLineLine       = 2
+	pprofLineColumn     = 3
+
+	pprofFunctionID        = 1
+	pprofFunctionName      = 2
+	pprofFunctionFilename  = 4
+	pprofFunctionStartLine = 5
+)
+
+// Write writes the profile in the gzipped protocol buffer format of pprof.
+// It has two sample types, "nodes" (count) and "time" (nanoseconds).
+func (p *Profiler) Write(w io.Writer) error {
+	var profile protoBuffer
+	stringTable := []string{""}
+	stringIndex := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		index, ok := stringIndex[s]
+		if !ok {
+			index = int64(len(stringTable))
+			stringTable = append(stringTable, s)
+			stringIndex[s] = index
+		}
+		return index
+	}
+	valueType := func(field int, typ, unit string) {
+		typeIndex, unitIndex := str(typ), str(unit)
+		b := func(b *protoBuffer) {
+			b.int64(pprofValueTypeType, typeIndex)
+			b.int64(pprofValueTypeUnit, unitIndex)
+		}
+		profile.message(field, b)
+	}
+
+	valueType(pprofSampleType, "nodes", "count")
+	valueType(pprofSampleType, "time", "nanoseconds")
+	for _, sample := range p.sampleList {
+		profile.message(pprofSample, func(b *protoBuffer) {
+			b.packed(pprofSampleLocationID, sample.stack)
+			b.packed(pprofSampleValue, []uint64{uint64(sample.nodes), uint64(sample.nanoseconds)})
+		})
+	}
+	for index, location := range p.locationList {
+		profile.message(pprofLocation, func(b *protoBuffer) {
+			b.uint64(pprofLocationID, uint64(index+1))
+			b.message(pprofLocationLine, func(b *protoBuffer) {
+				b.uint64(pprofLineFunctionID, location.function)
+				b.int64(pprofLineLine, int64(location.line))
+				b.int64(pprofLineColumn, int64(location.column))
+			})
+		})
+	}
+	for index, function := range p.functionList {
+		name, file := str(function.name), str(function.file)
+		profile.message(pprofFunction, func(b *protoBuffer) {
+			b.uint64(pprofFunctionID, uint64(index+1))
+			b.int64(pprofFunctionName, name)
+			b.int64(pprofFunctionFilename, file)
+			b.int64(pprofFunctionStartLine, int64(function.definition.Line))
+		})
+	}
+	profile.int64(pprofTimeNanos, p.start.UnixNano())
+	profile.int64(pprofDurationNanos, int64(time.Since(p.start)))
+	valueType(pprofPeriodType, "time", "nanoseconds")
+	profile.int64(pprofPeriod, 1)
+	profile.int64(pprofDefaultSampleType, str("time"))
+	for _, s := range stringTable {
+		profile.string(pprofStringTable, s)
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(profile.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -16,12 +16,20 @@ limitations under the License.
 
 package jsonnet
 
-import "github.com/google/go-jsonnet/ast"
+import (
+	"errors"
+
+	"github.com/google/go-jsonnet/ast"
+)
 
 // RuntimeError is an error discovered during evaluation of the program
 type RuntimeError struct {
 	Msg        string
 	StackTrace []TraceFrame
+	// Err is the underlying cause of the error, if there is one, for example
+	// context.Canceled when the evaluation was aborted. It is nil for errors
+	// raised by the Jsonnet program itself.
+	Err error
 }
 
 func makeRuntimeError(msg string, stackTrace []TraceFrame) RuntimeError {
@@ -31,10 +39,33 @@ func makeRuntimeError(msg string, stackTrace []TraceFrame) RuntimeError {
 	}
 }
 
+func makeRuntimeErrorWithCause(msg string, stackTrace []TraceFrame, cause error) RuntimeError {
+	return RuntimeError{
+		Msg:        msg,
+		StackTrace: stackTrace,
+		Err:        cause,
+	}
+}
+
 func (err RuntimeError) Error() string {
 	return "RUNTIME ERROR: " + err.Msg
 }
 
+// Unwrap returns the underlying cause of the error, so that it can be
+// checked with errors.Is and errors.As.
+func (err RuntimeError) Unwrap() error {
+	return err.Err
+}
+
+// Errors wrapped by the RuntimeError returned when one of the resource limits
+// of the VM is exceeded. They can be told apart from errors caused by the
+// Jsonnet program itself using errors.Is.
+var (
+	ErrMaxStepsExceeded       = errors.New("max evaluation steps exceeded")
+	ErrMaxAllocationsExceeded = errors.New("max allocations exceeded")
+	ErrMaxOutputSizeExceeded  = errors.New("max output size exceeded")
+)
+
 // The stack
 
 // TraceFrame is tracing information about a single frame of the call stack.
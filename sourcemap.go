@@ -0,0 +1,136 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/google/go-jsonnet/ast"
+)
+
+// SourceMap maps the fields of the manifested JSON, identified by JSON
+// pointers (RFC 6901) like "/spec/template/spec/containers/0/image", to
+// the Jsonnet code which defined them.
+type SourceMap map[string]SourceMapEntry
+
+// SourceMapEntry describes where the value of a field came from.
+type SourceMapEntry struct {
+	// Definition is the location of the field which the value is based on.
+	Definition ast.LocationRange
+	// Overrides are the locations of the field+: overrides applied to the
+	// definition, in the order they were applied.
+	Overrides []ast.LocationRange
+}
+
+type sourceMapPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type sourceMapLocation struct {
+	File  string            `json:"file"`
+	Begin sourceMapPosition `json:"begin"`
+	End   sourceMapPosition `json:"end"`
+}
+
+func makeSourceMapLocation(loc ast.LocationRange) sourceMapLocation {
+	return sourceMapLocation{
+		File:  diagnosticFileName(&loc),
+		Begin: sourceMapPosition{Line: loc.Begin.Line, Column: loc.Begin.Column},
+		End:   sourceMapPosition{Line: loc.End.Line, Column: loc.End.Column},
+	}
+}
+
+// MarshalJSON encodes the entry like
+// {"definition": {"file": "a.jsonnet", "begin": {"line": 1, "column": 5}, "end": ...}, "overrides": [...]}.
+func (entry SourceMapEntry) MarshalJSON() ([]byte, error) {
+	overrides := make([]sourceMapLocation, len(entry.Overrides))
+	for index, loc := range entry.Overrides {
+		overrides[index] = makeSourceMapLocation(loc)
+	}
+	return json.Marshal(struct {
+		Definition sourceMapLocation   `json:"definition"`
+		Overrides  []sourceMapLocation `json:"overrides"`
+	}{makeSourceMapLocation(entry.Definition), overrides})
+}
+
+// sourceMapBuilder collects the source map during manifestation. Its
+// methods do nothing if it is nil, i.e. when no source map is requested.
+type sourceMapBuilder struct {
+	sourceMap SourceMap
+	// path holds the escaped JSON pointer tokens of the current value.
+	path []string
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func (b *sourceMapBuilder) push(token string) {
+	if b == nil {
+		return
+	}
+	b.path = append(b.path, jsonPointerEscaper.Replace(token))
+}
+
+func (b *sourceMapBuilder) pop() {
+	if b == nil {
+		return
+	}
+	b.path = b.path[:len(b.path)-1]
+}
+
+func isPlusSuperField(field unboundField) bool {
+	switch field := field.(type) {
+	case *plusSuperUnboundField:
+		return true
+	case *bindingsUnboundField:
+		return isPlusSuperField(field.inner)
+	}
+	return false
+}
+
+// recordField records the layers of the object which define the field at
+// the current path. It goes from the top of the inheritance chain down
+// through the field+: overrides to the field which they are applied to.
+func (b *sourceMapBuilder) recordField(obj *valueObject, fieldName string) {
+	if b == nil {
+		return
+	}
+	var layers []ast.LocationRange
+	minSuperDepth := 0
+	for {
+		found, field, _, _, foundAt := findField(obj.uncached, minSuperDepth, fieldName)
+		if !found {
+			break
+		}
+		if field.loc != nil {
+			layers = append(layers, *field.loc)
+		}
+		if !isPlusSuperField(field.field) {
+			break
+		}
+		minSuperDepth = foundAt + 1
+	}
+	if len(layers) == 0 {
+		return
+	}
+	entry := SourceMapEntry{Definition: layers[len(layers)-1]}
+	for index := len(layers) - 2; index >= 0; index-- {
+		entry.Overrides = append(entry.Overrides, layers[index])
+	}
+	b.sourceMap["/"+strings.Join(b.path, "/")] = entry
+}
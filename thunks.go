@@ -164,7 +164,7 @@ func (f *plusSuperUnboundField) evaluate(i *interpreter, sb selfBinding, origBin
 		return nil, err
 	}
 
-	return value, nil
+	return allocatedResult(i, value, left, right)
 }
 
 func (f *plusSuperUnboundField) loc() *ast.LocationRange {
@@ -254,15 +254,24 @@ func makeClosure(env environment, function *ast.Function) *closure {
 }
 
 // NativeFunction represents a function implemented in Go.
-type NativeFunction struct {
+type NativeFunction struct { //nolint:govet
 	Name   string
 	Func   func([]interface{}) (interface{}, error)
 	Params ast.Identifiers
+	// Defaults are the values of the optional parameters, in any form
+	// supported by VM.ExtValue. The parameters without defaults are required.
+	Defaults map[ast.Identifier]interface{}
+	// Variadic makes the last parameter take all the remaining positional
+	// arguments, as an array.
+	Variadic bool
 }
 
 // evalCall evaluates a call to a NativeFunction and returns the result.
 func (native *NativeFunction) evalCall(arguments callArguments, i *interpreter) (value, error) {
-	flatArgs := flattenArgs(arguments, native.parameters(), []value{})
+	flatArgs, err := flattenNativeArgs(i, arguments, native.parameters(), native.Defaults)
+	if err != nil {
+		return nil, err
+	}
 	nativeArgs := make([]interface{}, 0, len(flatArgs))
 	for _, arg := range flatArgs {
 		v, err := i.evaluatePV(arg)
@@ -287,14 +296,119 @@ func (native *NativeFunction) evalCall(arguments callArguments, i *interpreter)
 	if err != nil {
 		return nil, i.Error(err.Error())
 	}
-	return jsonToValue(i, resultJSON)
+	result, err := jsonToValue(i, resultJSON)
+	if err != nil {
+		return nil, err
+	}
+	return allocatedResult(i, result)
 }
 
 // Parameters returns a NativeFunction's parameters.
 func (native *NativeFunction) parameters() []namedParameter {
-	ret := make([]namedParameter, len(native.Params))
+	return nativeParameters(native.Params, native.Defaults, native.Variadic)
+}
+
+func nativeParameters(params ast.Identifiers, defaults map[ast.Identifier]interface{}, variadic bool) []namedParameter {
+	ret := make([]namedParameter, len(params))
 	for i := range ret {
-		ret[i].name = native.Params[i]
+		ret[i].name = params[i]
+		if _, optional := defaults[params[i]]; optional {
+			// Like in generalBuiltin, it only marks the parameter as optional.
+			ret[i].defaultArg = &ast.LiteralNull{}
+		}
+	}
+	if variadic && len(ret) > 0 {
+		ret[len(ret)-1].variadic = true
+		ret[len(ret)-1].defaultArg = nil
 	}
 	return ret
 }
+
+// flattenNativeArgs binds the arguments of a native function call to
+// the parameters, like flattenArgs, but it also handles the variadic parameter
+// and the defaults in the native (Go) form.
+func flattenNativeArgs(i *interpreter, args callArguments, params []namedParameter, defaults map[ast.Identifier]interface{}) ([]*cachedThunk, error) {
+	numFixed := len(params)
+	var rest []*cachedThunk
+	if numFixed > 0 && params[numFixed-1].variadic {
+		numFixed--
+		if len(args.positional) > numFixed {
+			rest = args.positional[numFixed:]
+			args.positional = args.positional[:numFixed]
+		}
+	}
+
+	positions := make(map[ast.Identifier]int, len(params))
+	for index, param := range params {
+		positions[param.name] = index
+	}
+	flatArgs := make([]*cachedThunk, len(params))
+	copy(flatArgs, args.positional)
+	for _, arg := range args.named {
+		flatArgs[positions[arg.name]] = arg.pv
+	}
+	for index := 0; index < numFixed; index++ {
+		if flatArgs[index] == nil {
+			v, err := goToValue(i, defaults[params[index].name])
+			if err != nil {
+				return nil, err
+			}
+			flatArgs[index] = readyThunk(v)
+		}
+	}
+	if numFixed < len(params) {
+		flatArgs[numFixed] = readyThunk(makeValueArray(rest))
+	}
+	return flatArgs, nil
+}
+
+// LazyNativeFunction represents a function implemented in Go, which receives
+// its arguments as Value handles instead of manifested JSON. The arguments
+// are only evaluated when they are accessed, so they may be functions
+// (which can be called back) or objects with hidden fields.
+//
+// The result may be a *Value or any Go value supported by VM.ExtValue.
+// The Value handles are only valid during the call.
+type LazyNativeFunction struct { //nolint:govet
+	Name   string
+	Func   func([]*Value) (interface{}, error)
+	Params ast.Identifiers
+	// Defaults and Variadic work like in NativeFunction.
+	Defaults map[ast.Identifier]interface{}
+	Variadic bool
+}
+
+// evalCall evaluates a call to a LazyNativeFunction and returns the result.
+func (native *LazyNativeFunction) evalCall(arguments callArguments, i *interpreter) (value, error) {
+	flatArgs, err := flattenNativeArgs(i, arguments, native.parameters(), native.Defaults)
+	if err != nil {
+		return nil, err
+	}
+	nativeArgs := make([]*Value, 0, len(flatArgs))
+	for _, arg := range flatArgs {
+		nativeArgs = append(nativeArgs, &Value{i: i, th: arg, nested: true})
+	}
+	call := func() (result interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("native function %#v panicked: %v", native.Name, r)
+			}
+		}()
+		return native.Func(nativeArgs)
+	}
+	result, err := call()
+	if err != nil {
+		if _, isRuntimeError := err.(RuntimeError); isRuntimeError {
+			// An error from evaluating the arguments, which already has
+			// the right stack trace.
+			return nil, err
+		}
+		return nil, i.Error(err.Error())
+	}
+	return goToValue(i, result)
+}
+
+// Parameters returns a LazyNativeFunction's parameters.
+func (native *LazyNativeFunction) parameters() []namedParameter {
+	return nativeParameters(native.Params, native.Defaults, native.Variadic)
+}
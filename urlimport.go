@@ -0,0 +1,245 @@
+/*
+Copyright 2024 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonnet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Fetcher downloads the contents of a URL for URLImporter.
+type Fetcher interface {
+	Fetch(url string) ([]byte, error)
+}
+
+// HTTPFetcher fetches URLs with an HTTP GET request.
+type HTTPFetcher struct {
+	// Client is used for the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Fetch downloads the URL. Responses other than 200 OK are errors.
+func (fetcher *HTTPFetcher) Fetch(url string) ([]byte, error) {
+	client := fetcher.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// URLImporter imports files from URLs, e.g.
+// import "https://example.com/lib.libsonnet".
+//
+// The returned foundAt is the URL, so relative imports in remote files are
+// resolved against it. Imports which are not URLs and not relative to a
+// remote file are passed to Importer, e.g. a FileImporter. If it is nil,
+// only URLs can be imported.
+//
+// If CacheDir is set, the fetched files are stored there, addressed by the
+// SHA-256 of their contents. The files whose hashes are pinned by Lockfile
+// are read from the cache and only fetched if they are missing. In Offline
+// mode, files are only read from the cache and nothing is fetched.
+type URLImporter struct {
+	Importer Importer
+	// Fetcher downloads the files. If nil, an HTTPFetcher is used.
+	Fetcher  Fetcher
+	CacheDir string
+	contents map[string]Contents
+	Offline  bool
+	// Lockfile pins the expected hashes of the URLs, usually the same
+	// lockfile as the one the VM verifies the imports with.
+	Lockfile *Lockfile
+}
+
+// parseImportURL returns the URL of an import, if it is one.
+func parseImportURL(importedFrom, importedPath string) (*url.URL, bool) {
+	if u, err := url.Parse(importedPath); err == nil && u.IsAbs() && u.Host != "" {
+		return u, true
+	}
+	base, err := url.Parse(importedFrom)
+	if err != nil || !base.IsAbs() || base.Host == "" {
+		return nil, false
+	}
+	ref, err := url.Parse(importedPath)
+	if err != nil {
+		return nil, false
+	}
+	return base.ResolveReference(ref), true
+}
+
+// Import fetches the URL or passes the import to the wrapped importer.
+func (importer *URLImporter) Import(importedFrom, importedPath string) (contents Contents, foundAt string, err error) {
+	u, isURL := parseImportURL(importedFrom, importedPath)
+	if !isURL {
+		if importer.Importer == nil {
+			return Contents{}, "", fmt.Errorf("couldn't open import %#v: not a URL", importedPath)
+		}
+		return importer.Importer.Import(importedFrom, importedPath)
+	}
+	foundAt = u.String()
+	if importer.contents == nil {
+		importer.contents = make(map[string]Contents)
+	}
+	if contents, isCached := importer.contents[foundAt]; isCached {
+		return contents, foundAt, nil
+	}
+	data, err := importer.fetch(foundAt)
+	if err != nil {
+		return Contents{}, "", fmt.Errorf("couldn't open import %#v: %v", importedPath, err)
+	}
+	contents = MakeContentsRaw(data)
+	importer.contents[foundAt] = contents
+	return contents, foundAt, nil
+}
+
+// Invalidate drops the file, so that it is fetched again. Files which are
+// not URLs are passed to the wrapped importer.
+func (importer *URLImporter) Invalidate(foundAt string) {
+	if _, isCached := importer.contents[foundAt]; isCached {
+		delete(importer.contents, foundAt)
+		return
+	}
+	if cachingImporter, ok := importer.Importer.(CachingImporter); ok {
+		cachingImporter.Invalidate(foundAt)
+	}
+}
+
+func (importer *URLImporter) fetch(url string) ([]byte, error) {
+	if hash, pinned := importer.pinnedHash(url); pinned && importer.CacheDir != "" {
+		data, err := importer.readContentCache(url, hash)
+		if err == nil || !os.IsNotExist(err) {
+			return data, err
+		}
+	}
+	if importer.Offline {
+		if importer.CacheDir == "" {
+			return nil, fmt.Errorf("cannot fetch %s in offline mode without a cache directory", url)
+		}
+		data, err := importer.readCache(url)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s is not in the cache (offline mode)", url)
+		}
+		return data, err
+	}
+	fetcher := importer.Fetcher
+	if fetcher == nil {
+		fetcher = &HTTPFetcher{}
+	}
+	data, err := fetcher.Fetch(url)
+	if err != nil {
+		return nil, err
+	}
+	if importer.CacheDir != "" {
+		if err := importer.writeCache(url, data); err != nil {
+			return nil, fmt.Errorf("caching %s: %v", url, err)
+		}
+	}
+	return data, nil
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// The cache has two parts. The contents are stored in sha256/<hash of the
+// contents> and urls/<hash of the URL> holds the hash of the contents.
+func (importer *URLImporter) urlCachePath(url string) string {
+	return filepath.Join(importer.CacheDir, "urls", sha256Hex([]byte(url)))
+}
+
+func (importer *URLImporter) contentCachePath(hash string) string {
+	return filepath.Join(importer.CacheDir, "sha256", hash)
+}
+
+// pinnedHash returns the hex SHA-256 of the contents of the URL in the
+// lockfile, if it is there.
+func (importer *URLImporter) pinnedHash(url string) (string, bool) {
+	if importer.Lockfile == nil {
+		return "", false
+	}
+	hash, pinned := importer.Lockfile.Imports[url]
+	hash = strings.TrimPrefix(hash, "sha256:")
+	if decoded, err := hex.DecodeString(hash); !pinned || err != nil || len(decoded) != sha256.Size {
+		return "", false
+	}
+	return hash, true
+}
+
+func (importer *URLImporter) readCache(url string) ([]byte, error) {
+	hash, err := os.ReadFile(importer.urlCachePath(url))
+	if err != nil {
+		return nil, err
+	}
+	return importer.readContentCache(url, strings.TrimSpace(string(hash)))
+}
+
+func (importer *URLImporter) readContentCache(url, hash string) ([]byte, error) {
+	data, err := os.ReadFile(importer.contentCachePath(hash))
+	if err != nil {
+		return nil, err
+	}
+	if sha256Hex(data) != hash {
+		return nil, fmt.Errorf("cached contents of %s are corrupted", url)
+	}
+	return data, nil
+}
+
+func (importer *URLImporter) writeCache(url string, data []byte) error {
+	hash := sha256Hex(data)
+	if err := writeFileAtomic(importer.contentCachePath(hash), data); err != nil {
+		return err
+	}
+	return writeFileAtomic(importer.urlCachePath(url), []byte(hash+"\n"))
+}
+
+// writeFileAtomic writes the file through a temporary file, so that other
+// processes using the cache never see partially written files.
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -1,5 +1,7 @@
 package jsonnet
 
+import "github.com/google/go-jsonnet/ast"
+
 func minInt(a, b int) int {
 	if a < b {
 		return a
@@ -36,3 +38,12 @@ func float64Cmp(a, b float64) int {
 	}
 	return 0
 }
+
+// diagnosticFileName returns the name of the file of a location, which is
+// also set for snippets, unlike FileName.
+func diagnosticFileName(loc *ast.LocationRange) string {
+	if loc.File != nil {
+		return string(loc.File.DiagnosticFileName)
+	}
+	return loc.FileName
+}
@@ -358,6 +358,16 @@ func checkArguments(i *interpreter, args callArguments, params []namedParameter)
 	numNamed := len(args.named)
 	maxExpected := len(params)
 
+	// A variadic parameter takes all the remaining positional arguments,
+	// so it cannot be passed by name and it is never missing.
+	if maxExpected > 0 && params[maxExpected-1].variadic {
+		params = params[:maxExpected-1]
+		maxExpected--
+		if numPositional > maxExpected {
+			numPositional = maxExpected
+		}
+	}
+
 	if numPositional > maxExpected {
 		return i.Error(fmt.Sprintf("function expected %v positional argument(s), but got %v", maxExpected, numPositional))
 	}
@@ -370,7 +380,7 @@ func checkArguments(i *interpreter, args callArguments, params []namedParameter)
 
 	// Parameter names the call will bind.
 	received := make(map[ast.Identifier]bool, numPositional+numNamed)
-	for i := range args.positional {
+	for i := 0; i < numPositional; i++ {
 		received[params[i].name] = true
 	}
 	for _, arg := range args.named {
@@ -399,6 +409,8 @@ func (f *valueFunction) getType() *valueType {
 type namedParameter struct {
 	defaultArg ast.Node
 	name       ast.Identifier
+	// Only native functions may have a variadic (last) parameter.
+	variadic bool
 }
 
 type callArguments struct {
@@ -607,6 +619,9 @@ type simpleObjectFieldMap map[string]simpleObjectField
 type simpleObjectField struct {
 	field unboundField
 	hide  ast.ObjectFieldHide
+	// loc is the location of the whole field definition, e.g. `a+: 1`, or
+	// nil if the field does not come from code.
+	loc *ast.LocationRange
 }
 
 // unboundField is a field that doesn't know yet in which object it is.
@@ -17,7 +17,7 @@ limitations under the License.
 package jsonnet
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -36,15 +36,31 @@ import (
 
 // VM is the core interpreter and is the touchpoint used to parse and execute
 // Jsonnet.
+//
+// A VM is not safe for concurrent use. Use Clone to get VMs for other
+// goroutines which share the cache of imported files.
 type VM struct { //nolint:govet
-	MaxStack       int
+	MaxStack int
+	// MaxSteps limits the number of AST nodes evaluated in a single
+	// evaluation. Zero means no limit.
+	MaxSteps int
+	// MaxAllocations limits the total number of array elements and string
+	// characters created in a single evaluation. Zero means no limit.
+	MaxAllocations int
+	// MaxOutputSize limits the size in bytes of the manifested output.
+	// For the values returned by EvaluateValue and Value.Manifest, which
+	// are not serialized, it limits the total size of their scalars.
+	// Zero means no limit.
+	MaxOutputSize int
+
 	ext            vmExtMap
 	tla            vmExtMap
-	nativeFuncs    map[string]*NativeFunction
+	nativeFuncs    map[string]evalCallable
 	importer       Importer
 	ErrorFormatter ErrorFormatter
 	StringOutput   bool
 	importCache    *importCache
+	importLock     *importLock
 	traceOut       io.Writer
 	EvalHook       EvalHook
 }
@@ -53,15 +69,18 @@ type VM struct { //nolint:govet
 type extKind int
 
 const (
-	extKindVar  extKind = iota // a simple string
-	extKindCode                // a code snippet represented as a string
-	extKindNode                // an ast.Node that is passed in
+	extKindVar   extKind = iota // a simple string
+	extKindCode                 // a code snippet represented as a string
+	extKindNode                 // an ast.Node that is passed in
+	extKindValue                // a Go value that is passed in
 )
 
 // External variable or top level argument provided before execution
 type vmExt struct {
 	// the specified node for kind=extKindNode
 	node ast.Node
+	// the specified Go value for kind=extKindValue
+	goValue interface{}
 	// jsonnet code to evaluate (kind=extKindCode) or string to pass (kind=extKindVar)
 	value string
 	// the kind of external variable that is specified.
@@ -77,10 +96,10 @@ func MakeVM() *VM {
 		MaxStack:       500,
 		ext:            make(vmExtMap),
 		tla:            make(vmExtMap),
-		nativeFuncs:    make(map[string]*NativeFunction),
+		nativeFuncs:    make(map[string]evalCallable),
 		ErrorFormatter: &termErrorFormatter{pretty: false, maxStackTraceSize: 20},
 		importer:       &FileImporter{},
-		importCache:    makeImportCache(defaultImporter),
+		importCache:    makeImportCache(defaultImporter, nil),
 		traceOut:       os.Stderr,
 		EvalHook: EvalHook{
 			pre:  func(i *interpreter, a ast.Node) {},
@@ -92,7 +111,7 @@ func MakeVM() *VM {
 // Fully flush cache. This should be executed when we are no longer sure that the source files
 // didn't change, for example when the importer changed.
 func (vm *VM) flushCache() {
-	vm.importCache = makeImportCache(vm.importer)
+	vm.importCache = makeImportCache(vm.importer, vm.importLock)
 }
 
 // Flush value cache. This should be executed when calculated values may no longer be up to date,
@@ -124,6 +143,17 @@ func (vm *VM) ExtNode(key string, node ast.Node) {
 	vm.flushValueCache()
 }
 
+// ExtValue binds a Jsonnet external var to the given Go value. The value is
+// converted following the rules of json.Marshal, i.e. maps, slices, numbers,
+// booleans, strings and structs (with json tags) are supported.
+//
+// The value is converted during evaluation, so it must not be modified
+// while the VM is in use.
+func (vm *VM) ExtValue(key string, v interface{}) {
+	vm.ext[key] = vmExt{goValue: v, kind: extKindValue}
+	vm.flushValueCache()
+}
+
 // ExtReset rests all external variables registered for this VM.
 func (vm *VM) ExtReset() {
 	vm.ext = make(vmExtMap)
@@ -150,6 +180,13 @@ func (vm *VM) TLANode(key string, node ast.Node) {
 	// Setting a TLA does not require flushing the cache - see above.
 }
 
+// TLAValue binds a Jsonnet top level argument to the given Go value.
+// See ExtValue for the supported values.
+func (vm *VM) TLAValue(key string, v interface{}) {
+	vm.tla[key] = vmExt{goValue: v, kind: extKindValue}
+	// Setting a TLA does not require flushing the cache - see above.
+}
+
 // TLAReset resets all TLAs registered for this VM.
 func (vm *VM) TLAReset() {
 	vm.tla = make(vmExtMap)
@@ -161,18 +198,118 @@ func (vm *VM) Importer(i Importer) {
 	vm.flushCache()
 }
 
+// InvalidateImport makes the VM read the file found at foundAt again the
+// next time it is imported, e.g. after it was changed. The values of all
+// files which import it, directly or transitively, are evaluated again too,
+// but they are not read and parsed again.
+//
+// The cache is shared with the clones of the VM, so the file is invalidated
+// for them as well. The importer must implement CachingImporter if it
+// caches the files itself, like FileImporter does.
+func (vm *VM) InvalidateImport(foundAt string) {
+	vm.importCache.invalidate(foundAt)
+}
+
+// ImportedFiles returns the foundAt of all files imported by the VM and its
+// clones, including the ones read by importstr and importbin, in sorted
+// order. The files are forgotten when the cache is flushed, e.g. when
+// the importer changes, or when they are invalidated.
+func (vm *VM) ImportedFiles() []string {
+	return vm.importCache.importedFiles()
+}
+
+// Lockfile makes the VM record the hashes of all imported files in the
+// lockfile or verify them against it, depending on the mode. Pass nil to
+// stop using a lockfile. The lockfile is shared with the clones of the VM
+// and must not be accessed while any of them is evaluating.
+func (vm *VM) Lockfile(lockfile *Lockfile, mode LockfileMode) {
+	if lockfile == nil {
+		vm.importLock = nil
+	} else {
+		vm.importLock = &importLock{lockfile: lockfile, mode: mode}
+	}
+	vm.flushCache()
+}
+
 // NativeFunction registers a native function.
 func (vm *VM) NativeFunction(f *NativeFunction) {
 	vm.nativeFuncs[f.Name] = f
 	vm.flushValueCache()
 }
 
+// LazyNativeFunction registers a native function which receives its arguments
+// as lazy Value handles. It replaces a NativeFunction with the same name.
+func (vm *VM) LazyNativeFunction(f *LazyNativeFunction) {
+	vm.nativeFuncs[f.Name] = f
+	vm.flushValueCache()
+}
+
+// Clone creates a new VM with the same configuration as vm. The external
+// variables, top-level arguments and native functions are copied, so they
+// can be changed independently. The importer and the cache of imported
+// files (and their parsed ASTs) are shared.
+//
+// A VM must not be used concurrently, but vm and its clones may be used
+// from different goroutines at the same time. The importer is never called
+// concurrently by them.
+func (vm *VM) Clone() *VM {
+	clone := *vm
+	clone.ext = make(vmExtMap, len(vm.ext))
+	for key, val := range vm.ext {
+		clone.ext[key] = val
+	}
+	clone.tla = make(vmExtMap, len(vm.tla))
+	for key, val := range vm.tla {
+		clone.tla[key] = val
+	}
+	clone.nativeFuncs = make(map[string]evalCallable, len(vm.nativeFuncs))
+	for name, f := range vm.nativeFuncs {
+		clone.nativeFuncs[name] = f
+	}
+	clone.importCache = vm.importCache.clone()
+	return &clone
+}
+
+// NativeSignature describes the parameters of a native function.
+type NativeSignature struct {
+	// Params are the parameters of the function. The optional ones have
+	// a non-nil DefaultArg, which is only a placeholder.
+	Params []ast.Parameter
+	// Variadic is true if the last parameter takes all the remaining
+	// positional arguments.
+	Variadic bool
+}
+
+// NativeSignatures returns the signatures of the registered native functions,
+// e.g. for static analysis.
+func (vm *VM) NativeSignatures() map[string]NativeSignature {
+	result := make(map[string]NativeSignature, len(vm.nativeFuncs))
+	for name, f := range vm.nativeFuncs {
+		var sig NativeSignature
+		for _, param := range f.parameters() {
+			sig.Params = append(sig.Params, ast.Parameter{Name: param.name, DefaultArg: param.defaultArg})
+			sig.Variadic = param.variadic
+		}
+		result[name] = sig
+	}
+	return result
+}
+
+func (vm *VM) evalLimits() evalLimits {
+	return evalLimits{
+		maxSteps:       vm.MaxSteps,
+		maxAllocations: vm.MaxAllocations,
+		maxOutputSize:  vm.MaxOutputSize,
+	}
+}
+
 type evalKind int
 
 const (
 	evalKindRegular evalKind = iota
 	evalKindMulti            = iota
 	evalKindStream           = iota
+	evalKindValue            = iota
 )
 
 // version is the current gojsonnet's version
@@ -182,38 +319,115 @@ const version = "v0.20.0"
 // and returns serialized JSON as string.
 // TODO(sbarzowski) perhaps is should return JSON in standard Go representation
 func (vm *VM) Evaluate(node ast.Node) (val string, err error) {
+	return vm.EvaluateContext(context.Background(), node)
+}
+
+// EvaluateContext is like Evaluate, but it aborts the evaluation when ctx is
+// done. The returned RuntimeError wraps ctx.Err() in that case.
+func (vm *VM) EvaluateContext(ctx context.Context, node ast.Node) (val string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
 		}
 	}()
-	return evaluate(node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
+	return evaluate(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
 }
 
 // EvaluateStream evaluates a Jsonnet program given by an Abstract Syntax Tree
 // and returns an array of JSON strings.
 func (vm *VM) EvaluateStream(node ast.Node) (output []string, err error) {
+	return vm.EvaluateStreamContext(context.Background(), node)
+}
+
+// EvaluateStreamContext is like EvaluateStream, but it aborts the evaluation
+// when ctx is done. The returned RuntimeError wraps ctx.Err() in that case.
+func (vm *VM) EvaluateStreamContext(ctx context.Context, node ast.Node) (output []string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
 		}
 	}()
-	return evaluateStream(node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.importCache, vm.traceOut, vm.EvalHook)
+	return evaluateStream(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.EvalHook)
 }
 
 // EvaluateMulti evaluates a Jsonnet program given by an Abstract Syntax Tree
 // and returns key-value pairs.
 // The keys are strings and the values are JSON strigns (serialized JSON).
 func (vm *VM) EvaluateMulti(node ast.Node) (output map[string]string, err error) {
+	return vm.EvaluateMultiContext(context.Background(), node)
+}
+
+// EvaluateMultiContext is like EvaluateMulti, but it aborts the evaluation
+// when ctx is done. The returned RuntimeError wraps ctx.Err() in that case.
+func (vm *VM) EvaluateMultiContext(ctx context.Context, node ast.Node) (output map[string]string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
+		}
+	}()
+	return evaluateMulti(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
+}
+
+// EvaluateValue evaluates a Jsonnet program given by an Abstract Syntax Tree
+// and returns the result in the standard Go representation of JSON
+// (as in "encoding/json" package), i.e. nil, bool, float64, string,
+// []interface{} and map[string]interface{}.
+func (vm *VM) EvaluateValue(node ast.Node) (val interface{}, err error) {
+	return vm.EvaluateValueContext(context.Background(), node)
+}
+
+// EvaluateValueContext is like EvaluateValue, but it aborts the evaluation
+// when ctx is done. The returned RuntimeError wraps ctx.Err() in that case.
+func (vm *VM) EvaluateValueContext(ctx context.Context, node ast.Node) (val interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
+		}
+	}()
+	return evaluateValue(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.EvalHook)
+}
+
+// EvaluateLazy evaluates a Jsonnet program given by an Abstract Syntax Tree
+// and returns a handle to the result, without manifesting it. The contents
+// of the result are evaluated when they are accessed through the handle.
+func (vm *VM) EvaluateLazy(node ast.Node) (val *Value, err error) {
+	return vm.EvaluateLazyContext(context.Background(), node)
+}
+
+// EvaluateLazyContext is like EvaluateLazy, but it aborts the evaluation
+// when ctx is done, also the evaluation of the contents of the result when
+// they are accessed later. The returned RuntimeError wraps ctx.Err() in
+// that case.
+func (vm *VM) EvaluateLazyContext(ctx context.Context, node ast.Node) (val *Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
+		}
+	}()
+	i, err := buildInterpreter(ctx, vm.ext, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.EvalHook)
+	if err != nil {
+		return nil, err
+	}
+	result, err := evaluateAux(i, node, vm.tla)
+	if err != nil {
+		return nil, err
+	}
+	return &Value{vm: vm, i: i, th: readyThunk(result)}, nil
+}
+
+// EvaluateSourceMap is like Evaluate, but it also returns a SourceMap
+// which tells where each field of the output was defined and overridden.
+// StringOutput is not supported.
+func (vm *VM) EvaluateSourceMap(node ast.Node) (val string, sourceMap SourceMap, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
 		}
 	}()
-	return evaluateMulti(node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
+	return evaluateSourceMap(context.Background(), node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.EvalHook)
 }
 
-func (vm *VM) evaluateSnippet(diagnosticFileName ast.DiagnosticFileName, filename string, snippet string, kind evalKind) (output interface{}, err error) {
+func (vm *VM) evaluateSnippet(ctx context.Context, diagnosticFileName ast.DiagnosticFileName, filename string, snippet string, kind evalKind) (output interface{}, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("(CRASH) %v\n%s", r, debug.Stack())
@@ -225,11 +439,13 @@ func (vm *VM) evaluateSnippet(diagnosticFileName ast.DiagnosticFileName, filenam
 	}
 	switch kind {
 	case evalKindRegular:
-		output, err = evaluate(node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
+		output, err = evaluate(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
 	case evalKindMulti:
-		output, err = evaluateMulti(node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
+		output, err = evaluateMulti(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.StringOutput, vm.EvalHook)
 	case evalKindStream:
-		output, err = evaluateStream(node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.importCache, vm.traceOut, vm.EvalHook)
+		output, err = evaluateStream(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.EvalHook)
+	case evalKindValue:
+		output, err = evaluateValue(ctx, node, vm.ext, vm.tla, vm.nativeFuncs, vm.MaxStack, vm.evalLimits(), vm.importCache, vm.traceOut, vm.EvalHook)
 	}
 	if err != nil {
 		return "", err
@@ -237,6 +453,26 @@ func (vm *VM) evaluateSnippet(diagnosticFileName ast.DiagnosticFileName, filenam
 	return output, nil
 }
 
+// formattedError is returned by the functions which format errors using the
+// ErrorFormatter. It keeps the original error, so that it can be still
+// inspected with errors.Is and errors.As.
+type formattedError struct {
+	msg string
+	err error
+}
+
+func (err *formattedError) Error() string {
+	return err.msg
+}
+
+func (err *formattedError) Unwrap() error {
+	return err.err
+}
+
+func (vm *VM) formatError(err error) error {
+	return &formattedError{msg: vm.ErrorFormatter.Format(err), err: err}
+}
+
 func getAbsPath(path string) (string, error) {
 	var absPath string
 	if filepath.IsAbs(path) {
@@ -248,6 +484,14 @@ func getAbsPath(path string) (string, error) {
 		}
 		absPath = strings.Join([]string{wd, path}, string(filepath.Separator))
 	}
+	if archivePath, entry, inArchive := splitArchivePath(absPath); inArchive {
+		// Only the archive itself exists on the filesystem.
+		cleanedArchivePath, err := filepath.EvalSymlinks(archivePath)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(cleanedArchivePath, filepath.FromSlash(entry)), nil
+	}
 	cleanedAbsPath, err := filepath.EvalSymlinks(absPath)
 	if err != nil {
 		return "", err
@@ -265,7 +509,7 @@ func (vm *VM) findDependencies(filePath string, node *ast.Node, dependencies map
 			return err
 		}
 		cleanedAbsPath = foundAt
-		if _, isFileImporter := vm.importer.(*FileImporter); isFileImporter {
+		if usesFilesystemPaths(vm.importer, foundAt) {
 			cleanedAbsPath, err = getAbsPath(foundAt)
 			if err != nil {
 				*stackTrace = append([]TraceFrame{{Loc: *i.Loc()}}, *stackTrace...)
@@ -289,7 +533,7 @@ func (vm *VM) findDependencies(filePath string, node *ast.Node, dependencies map
 			return err
 		}
 		cleanedAbsPath = foundAt
-		if _, isFileImporter := vm.importer.(*FileImporter); isFileImporter {
+		if usesFilesystemPaths(vm.importer, foundAt) {
 			cleanedAbsPath, err = getAbsPath(foundAt)
 			if err != nil {
 				*stackTrace = append([]TraceFrame{{Loc: *i.Loc()}}, *stackTrace...)
@@ -304,7 +548,7 @@ func (vm *VM) findDependencies(filePath string, node *ast.Node, dependencies map
 			return err
 		}
 		cleanedAbsPath = foundAt
-		if _, isFileImporter := vm.importer.(*FileImporter); isFileImporter {
+		if usesFilesystemPaths(vm.importer, foundAt) {
 			cleanedAbsPath, err = getAbsPath(foundAt)
 			if err != nil {
 				*stackTrace = append([]TraceFrame{{Loc: *i.Loc()}}, *stackTrace...)
@@ -330,9 +574,9 @@ func (vm *VM) findDependencies(filePath string, node *ast.Node, dependencies map
 //
 // Deprecated: Use EvaluateFile or EvaluateAnonymousSnippet instead.
 func (vm *VM) EvaluateSnippet(filename string, snippet string) (json string, formattedErr error) {
-	output, err := vm.evaluateSnippet(ast.DiagnosticFileName(filename), filename, snippet, evalKindRegular)
+	output, err := vm.evaluateSnippet(context.Background(), ast.DiagnosticFileName(filename), filename, snippet, evalKindRegular)
 	if err != nil {
-		return "", errors.New(vm.ErrorFormatter.Format(err))
+		return "", vm.formatError(err)
 	}
 	json = output.(string)
 	return
@@ -345,9 +589,9 @@ func (vm *VM) EvaluateSnippet(filename string, snippet string) (json string, for
 //
 // Deprecated: Use EvaluateFileStream or EvaluateAnonymousSnippetStream instead.
 func (vm *VM) EvaluateSnippetStream(filename string, snippet string) (docs []string, formattedErr error) {
-	output, err := vm.evaluateSnippet(ast.DiagnosticFileName(filename), filename, snippet, evalKindStream)
+	output, err := vm.evaluateSnippet(context.Background(), ast.DiagnosticFileName(filename), filename, snippet, evalKindStream)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
 	docs = output.([]string)
 	return
@@ -360,9 +604,9 @@ func (vm *VM) EvaluateSnippetStream(filename string, snippet string) (docs []str
 //
 // Deprecated: Use EvaluateFileMulti or EvaluateAnonymousSnippetMulti instead.
 func (vm *VM) EvaluateSnippetMulti(filename string, snippet string) (files map[string]string, formattedErr error) {
-	output, err := vm.evaluateSnippet(ast.DiagnosticFileName(filename), filename, snippet, evalKindMulti)
+	output, err := vm.evaluateSnippet(context.Background(), ast.DiagnosticFileName(filename), filename, snippet, evalKindMulti)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
 	files = output.(map[string]string)
 	return
@@ -373,9 +617,15 @@ func (vm *VM) EvaluateSnippetMulti(filename string, snippet string) (files map[s
 //
 // The filename parameter is only used for error messages.
 func (vm *VM) EvaluateAnonymousSnippet(filename string, snippet string) (json string, formattedErr error) {
-	output, err := vm.evaluateSnippet(ast.DiagnosticFileName(filename), "", snippet, evalKindRegular)
+	return vm.EvaluateAnonymousSnippetContext(context.Background(), filename, snippet)
+}
+
+// EvaluateAnonymousSnippetContext is like EvaluateAnonymousSnippet, but it aborts
+// the evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateAnonymousSnippetContext(ctx context.Context, filename string, snippet string) (json string, formattedErr error) {
+	output, err := vm.evaluateSnippet(ctx, ast.DiagnosticFileName(filename), "", snippet, evalKindRegular)
 	if err != nil {
-		return "", errors.New(vm.ErrorFormatter.Format(err))
+		return "", vm.formatError(err)
 	}
 	json = output.(string)
 	return
@@ -386,9 +636,15 @@ func (vm *VM) EvaluateAnonymousSnippet(filename string, snippet string) (json st
 //
 // The filename parameter is only used for error messages.
 func (vm *VM) EvaluateAnonymousSnippetStream(filename string, snippet string) (docs []string, formattedErr error) {
-	output, err := vm.evaluateSnippet(ast.DiagnosticFileName(filename), "", snippet, evalKindStream)
+	return vm.EvaluateAnonymousSnippetStreamContext(context.Background(), filename, snippet)
+}
+
+// EvaluateAnonymousSnippetStreamContext is like EvaluateAnonymousSnippetStream, but it
+// aborts the evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateAnonymousSnippetStreamContext(ctx context.Context, filename string, snippet string) (docs []string, formattedErr error) {
+	output, err := vm.evaluateSnippet(ctx, ast.DiagnosticFileName(filename), "", snippet, evalKindStream)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
 	docs = output.([]string)
 	return
@@ -399,26 +655,109 @@ func (vm *VM) EvaluateAnonymousSnippetStream(filename string, snippet string) (d
 //
 // The filename parameter is only used for error messages.
 func (vm *VM) EvaluateAnonymousSnippetMulti(filename string, snippet string) (files map[string]string, formattedErr error) {
-	output, err := vm.evaluateSnippet(ast.DiagnosticFileName(filename), "", snippet, evalKindMulti)
+	return vm.EvaluateAnonymousSnippetMultiContext(context.Background(), filename, snippet)
+}
+
+// EvaluateAnonymousSnippetMultiContext is like EvaluateAnonymousSnippetMulti, but it
+// aborts the evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateAnonymousSnippetMultiContext(ctx context.Context, filename string, snippet string) (files map[string]string, formattedErr error) {
+	output, err := vm.evaluateSnippet(ctx, ast.DiagnosticFileName(filename), "", snippet, evalKindMulti)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
 	files = output.(map[string]string)
 	return
 }
 
+// EvaluateAnonymousSnippetValue evaluates a string containing Jsonnet code
+// and returns the result in the standard Go representation of JSON
+// (see EvaluateValue).
+//
+// The filename parameter is only used for error messages.
+func (vm *VM) EvaluateAnonymousSnippetValue(filename string, snippet string) (val interface{}, formattedErr error) {
+	return vm.EvaluateAnonymousSnippetValueContext(context.Background(), filename, snippet)
+}
+
+// EvaluateAnonymousSnippetValueContext is like EvaluateAnonymousSnippetValue, but it
+// aborts the evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateAnonymousSnippetValueContext(ctx context.Context, filename string, snippet string) (val interface{}, formattedErr error) {
+	output, err := vm.evaluateSnippet(ctx, ast.DiagnosticFileName(filename), "", snippet, evalKindValue)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	return output, nil
+}
+
+// EvaluateAnonymousSnippetInto evaluates a string containing Jsonnet code
+// and stores the result in the value pointed to by v, following the rules
+// of json.Unmarshal.
+//
+// The filename parameter is only used for error messages.
+func (vm *VM) EvaluateAnonymousSnippetInto(filename string, snippet string, v interface{}) error {
+	output, err := vm.EvaluateAnonymousSnippetValue(filename, snippet)
+	if err != nil {
+		return err
+	}
+	return decodeInto(output, v)
+}
+
+// EvaluateAnonymousSnippetLazy evaluates a string containing Jsonnet code
+// and returns a handle to the result (see EvaluateLazy).
+//
+// The filename parameter is only used for error messages.
+func (vm *VM) EvaluateAnonymousSnippetLazy(filename string, snippet string) (val *Value, formattedErr error) {
+	return vm.EvaluateAnonymousSnippetLazyContext(context.Background(), filename, snippet)
+}
+
+// EvaluateAnonymousSnippetLazyContext is like EvaluateAnonymousSnippetLazy, but it
+// aborts the evaluation when ctx is done (see EvaluateLazyContext).
+func (vm *VM) EvaluateAnonymousSnippetLazyContext(ctx context.Context, filename string, snippet string) (val *Value, formattedErr error) {
+	node, err := program.SnippetToAST(ast.DiagnosticFileName(filename), "", snippet)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	val, err = vm.EvaluateLazyContext(ctx, node)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	return val, nil
+}
+
+// EvaluateAnonymousSnippetSourceMap evaluates a string containing Jsonnet
+// code and returns a JSON string and its SourceMap (see EvaluateSourceMap).
+//
+// The filename parameter is only used for error messages and the locations
+// in the source map.
+func (vm *VM) EvaluateAnonymousSnippetSourceMap(filename string, snippet string) (json string, sourceMap SourceMap, formattedErr error) {
+	node, err := program.SnippetToAST(ast.DiagnosticFileName(filename), "", snippet)
+	if err != nil {
+		return "", nil, vm.formatError(err)
+	}
+	json, sourceMap, err = vm.EvaluateSourceMap(node)
+	if err != nil {
+		return "", nil, vm.formatError(err)
+	}
+	return json, sourceMap, nil
+}
+
 // EvaluateFile evaluates Jsonnet code in a file and returns a JSON
 // string.
 //
 // The importer is used to fetch the contents of the file.
 func (vm *VM) EvaluateFile(filename string) (json string, formattedErr error) {
-	node, _, err := vm.ImportAST("", filename)
+	return vm.EvaluateFileContext(context.Background(), filename)
+}
+
+// EvaluateFileContext is like EvaluateFile, but it aborts the evaluation
+// when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateFileContext(ctx context.Context, filename string) (json string, formattedErr error) {
+	node, _, err := vm.importCache.importEntrypoint("", filename)
 	if err != nil {
-		return "", errors.New(vm.ErrorFormatter.Format(err))
+		return "", vm.formatError(err)
 	}
-	output, err := vm.Evaluate(node)
+	output, err := vm.EvaluateContext(ctx, node)
 	if err != nil {
-		return "", errors.New(vm.ErrorFormatter.Format(err))
+		return "", vm.formatError(err)
 	}
 	return output, nil
 }
@@ -428,13 +767,19 @@ func (vm *VM) EvaluateFile(filename string) (json string, formattedErr error) {
 //
 // The importer is used to fetch the contents of the file.
 func (vm *VM) EvaluateFileStream(filename string) (docs []string, formattedErr error) {
-	node, _, err := vm.ImportAST("", filename)
+	return vm.EvaluateFileStreamContext(context.Background(), filename)
+}
+
+// EvaluateFileStreamContext is like EvaluateFileStream, but it aborts the
+// evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateFileStreamContext(ctx context.Context, filename string) (docs []string, formattedErr error) {
+	node, _, err := vm.importCache.importEntrypoint("", filename)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
-	output, err := vm.EvaluateStream(node)
+	output, err := vm.EvaluateStreamContext(ctx, node)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
 	return output, nil
 }
@@ -444,13 +789,157 @@ func (vm *VM) EvaluateFileStream(filename string) (docs []string, formattedErr e
 //
 // The importer is used to fetch the contents of the file.
 func (vm *VM) EvaluateFileMulti(filename string) (files map[string]string, formattedErr error) {
-	node, _, err := vm.ImportAST("", filename)
+	return vm.EvaluateFileMultiContext(context.Background(), filename)
+}
+
+// EvaluateFileMultiContext is like EvaluateFileMulti, but it aborts the
+// evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateFileMultiContext(ctx context.Context, filename string) (files map[string]string, formattedErr error) {
+	node, _, err := vm.importCache.importEntrypoint("", filename)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	output, err := vm.EvaluateMultiContext(ctx, node)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	return output, nil
+}
+
+// EvaluateFileValue evaluates Jsonnet code in a file and returns the result
+// in the standard Go representation of JSON (see EvaluateValue).
+//
+// The importer is used to fetch the contents of the file.
+func (vm *VM) EvaluateFileValue(filename string) (val interface{}, formattedErr error) {
+	return vm.EvaluateFileValueContext(context.Background(), filename)
+}
+
+// EvaluateFileValueContext is like EvaluateFileValue, but it aborts the
+// evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateFileValueContext(ctx context.Context, filename string) (val interface{}, formattedErr error) {
+	node, _, err := vm.importCache.importEntrypoint("", filename)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	output, err := vm.EvaluateValueContext(ctx, node)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	return output, nil
+}
+
+// EvaluateFileInto evaluates Jsonnet code in a file and stores the result in
+// the value pointed to by v, following the rules of json.Unmarshal.
+//
+// The importer is used to fetch the contents of the file.
+func (vm *VM) EvaluateFileInto(filename string, v interface{}) error {
+	output, err := vm.EvaluateFileValue(filename)
+	if err != nil {
+		return err
+	}
+	return decodeInto(output, v)
+}
+
+// EvaluateFileLazy evaluates Jsonnet code in a file and returns a handle
+// to the result (see EvaluateLazy).
+//
+// The importer is used to fetch the contents of the file.
+func (vm *VM) EvaluateFileLazy(filename string) (val *Value, formattedErr error) {
+	return vm.EvaluateFileLazyContext(context.Background(), filename)
+}
+
+// EvaluateFileLazyContext is like EvaluateFileLazy, but it aborts the
+// evaluation when ctx is done (see EvaluateLazyContext).
+func (vm *VM) EvaluateFileLazyContext(ctx context.Context, filename string) (val *Value, formattedErr error) {
+	node, _, err := vm.importCache.importEntrypoint("", filename)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	val, err = vm.EvaluateLazyContext(ctx, node)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	return val, nil
+}
+
+// EvaluateFileSourceMap evaluates Jsonnet code in a file and returns a JSON
+// string and its SourceMap (see EvaluateSourceMap).
+//
+// The importer is used to fetch the contents of the file.
+func (vm *VM) EvaluateFileSourceMap(filename string) (json string, sourceMap SourceMap, formattedErr error) {
+	node, _, err := vm.importCache.importEntrypoint("", filename)
+	if err != nil {
+		return "", nil, vm.formatError(err)
+	}
+	json, sourceMap, err = vm.EvaluateSourceMap(node)
+	if err != nil {
+		return "", nil, vm.formatError(err)
+	}
+	return json, sourceMap, nil
+}
+
+// Program is a parsed, desugared and statically analyzed Jsonnet program.
+// It is immutable, so it can be evaluated many times, also concurrently
+// (by different VMs), with different external variables and top-level
+// arguments.
+type Program struct {
+	node ast.Node
+}
+
+// Compile parses and analyzes Jsonnet code, so that it can be evaluated
+// later with EvaluateProgram and its variants. Relative imports are resolved
+// relative to the filename, which is also used in error messages.
+func (vm *VM) Compile(filename string, snippet string) (p *Program, formattedErr error) {
+	node, err := program.SnippetToAST(ast.DiagnosticFileName(filename), filename, snippet)
+	if err != nil {
+		return nil, vm.formatError(err)
+	}
+	return &Program{node: node}, nil
+}
+
+// EvaluateProgram evaluates a compiled program and returns a JSON string.
+func (vm *VM) EvaluateProgram(p *Program) (json string, formattedErr error) {
+	return vm.EvaluateProgramContext(context.Background(), p)
+}
+
+// EvaluateProgramContext is like EvaluateProgram, but it aborts the evaluation
+// when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateProgramContext(ctx context.Context, p *Program) (json string, formattedErr error) {
+	output, err := vm.EvaluateContext(ctx, p.node)
+	if err != nil {
+		return "", vm.formatError(err)
+	}
+	return output, nil
+}
+
+// EvaluateProgramStream evaluates a compiled program to an array.
+// The array is returned as an array of JSON strings.
+func (vm *VM) EvaluateProgramStream(p *Program) (docs []string, formattedErr error) {
+	return vm.EvaluateProgramStreamContext(context.Background(), p)
+}
+
+// EvaluateProgramStreamContext is like EvaluateProgramStream, but it aborts the
+// evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateProgramStreamContext(ctx context.Context, p *Program) (docs []string, formattedErr error) {
+	output, err := vm.EvaluateStreamContext(ctx, p.node)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
-	output, err := vm.EvaluateMulti(node)
+	return output, nil
+}
+
+// EvaluateProgramMulti evaluates a compiled program to key-value pairs.
+// The keys are field name strings and the values are JSON strings.
+func (vm *VM) EvaluateProgramMulti(p *Program) (files map[string]string, formattedErr error) {
+	return vm.EvaluateProgramMultiContext(context.Background(), p)
+}
+
+// EvaluateProgramMultiContext is like EvaluateProgramMulti, but it aborts the
+// evaluation when ctx is done. The returned error wraps ctx.Err() in that case.
+func (vm *VM) EvaluateProgramMultiContext(ctx context.Context, p *Program) (files map[string]string, formattedErr error) {
+	output, err := vm.EvaluateMultiContext(ctx, p.node)
 	if err != nil {
-		return nil, errors.New(vm.ErrorFormatter.Format(err))
+		return nil, vm.formatError(err)
 	}
 	return output, nil
 }
@@ -466,12 +955,12 @@ func (vm *VM) FindDependencies(importedFrom string, importedPaths []string) ([]s
 	deps := make(map[string]struct{})
 
 	for i, filePath := range importedPaths {
-		node, foundAt, err := vm.ImportAST(importedFrom, filePath)
+		node, foundAt, err := vm.importCache.importEntrypoint(importedFrom, filePath)
 		if err != nil {
 			return nil, err
 		}
 		cleanedAbsPath := foundAt
-		if _, isFileImporter := vm.importer.(*FileImporter); isFileImporter {
+		if usesFilesystemPaths(vm.importer, foundAt) {
 			cleanedAbsPath, err = getAbsPath(foundAt)
 			if err != nil {
 				return nil, err
@@ -490,7 +979,7 @@ func (vm *VM) FindDependencies(importedFrom string, importedPaths []string) ([]s
 		err := vm.findDependencies(filePath, nodes[i], deps, &stackTrace)
 		if err != nil {
 			err = makeRuntimeError(err.Error(), stackTrace)
-			return nil, errors.New(vm.ErrorFormatter.Format(err))
+			return nil, vm.formatError(err)
 		}
 	}
 